@@ -2,6 +2,8 @@
 
 package ruixuego
 
+import "strconv"
+
 const (
 	dateTimeFormat = "2006-01-02 15:04:05.000"
 )
@@ -16,6 +18,15 @@ const (
 	PresetKeyUUID         = "$uuid"
 	PresetKeyTime         = "$time"
 	PresetKeyIP           = "$ip"
+	PresetKeyRegion       = "$region"      // 区域, 仅用于上报请求头 ruixue-region, 不写入事件
+	PresetKeyServiceMark  = "$servicemark" // 区服标识, 仅用于上报请求头 ruixue-servicemark, 不写入事件
+)
+
+// SDK 自动添加的属性 Key
+const (
+	PropertyKeySampleRate      = "$sample_rate"      // 事件被采样时的采样率
+	PropertyKeyCPUserID        = "$cp_user_id"       // Identify 关联的 CP 用户 ID
+	PropertyKeyFirstDevicecode = "$first_devicecode" // Alias 关联的用户首次使用的设备码
 )
 
 const (
@@ -30,6 +41,28 @@ const (
 	UserMax         = "user_max"
 )
 
+// 埋点数据类型, 用于声明 EventSchema.Types
+const (
+	BigDataTypeTrack       = typeTrack
+	BigDataTypeUpdateTrack = typeUpdateTrack
+	BigDataTypeFirstTrack  = typeFirstTrack
+	BigDataTypeUser        = typeUser
+)
+
+// presetKeys 预置 Key 集合, 预置 Key 只能通过 SetPreset 设置
+var presetKeys = map[string]struct{}{
+	PresetKeyPlatformID:   {},
+	PresetKeyCPID:         {},
+	PresetKeyProductID:    {},
+	PresetKeyChannelID:    {},
+	PresetKeySubChannelID: {},
+	PresetKeyUUID:         {},
+	PresetKeyTime:         {},
+	PresetKeyIP:           {},
+	PresetKeyRegion:       {},
+	PresetKeyServiceMark:  {},
+}
+
 type BigDataLog struct {
 	Type         string                 `json:"type"`
 	Time         string                 `json:"time"`
@@ -44,8 +77,102 @@ type BigDataLog struct {
 	SubChannelID string                 `json:"sub_channel_id,omitempty"`
 	CPID         uint32                 `json:"cpid"`
 	PlatformID   int32                  `json:"platform_id"`
+
+	refs          int32       // 引用计数, 对象池创建的数据为 0 时放回对象池
+	ownProperties bool        // Properties 是否为 SDK 内部创建, 为 false 时修改前需先复制
+	seq           uint64      // 写入顺序, 上报失败放回缓存时用于恢复顺序
+	rawTime       interface{} // SetPreset 传入的事件时间, 构建事件时按配置的格式与时区转换为 Time
+	structTimes   bool        // 属性由结构体转换而来, 构建事件时将其中的 time.Time 按配置的格式与时区转换为字符串
+	region        string      // 上报请求头 ruixue-region, 为空时使用 Config.Region
+	serviceMark   string      // 上报请求头 ruixue-servicemark, 为空时使用 Config.ServiceMark
+	priority      Priority    // 优先级, 高优先级数据使用独立的缓存并优先上报
+}
+
+// Priority 事件优先级
+type Priority int8
+
+const (
+	PriorityNormal Priority = iota // 普通优先级
+	PriorityHigh                   // 高优先级, 如支付, 注册等关键事件
+)
+
+// routeKey 上报路由, 路由相同的数据才能在同一个请求中上报
+type routeKey struct {
+	cpID        uint32
+	productID   string
+	channelID   string
+	region      string
+	serviceMark string
+}
+
+func (l *BigDataLog) route() routeKey {
+	return routeKey{
+		cpID:        l.CPID,
+		productID:   l.ProductID,
+		channelID:   l.ChannelID,
+		region:      l.region,
+		serviceMark: l.serviceMark,
+	}
+}
+
+// setHeader 将路由写入上报请求头, 为空的字段使用 Config 中的默认值
+func (r routeKey) setHeader(h *ReqHeader) {
+	if r.cpID != 0 {
+		h.Set(headerCPID, strconv.FormatUint(uint64(r.cpID), 10))
+	}
+	if r.productID != "" {
+		h.Set(HeaderProductID, r.productID)
+	}
+	if r.channelID != "" {
+		h.Set(HeaderChannelID, r.channelID)
+	}
+	if r.region != "" {
+		h.Set(HeaderNameRegion, r.region)
+	}
+	if r.serviceMark != "" {
+		h.Set(HeaderServiceMark, r.serviceMark)
+	}
+}
+
+// setProperty 设置自定义属性, 不会修改调用方传入的 map
+func (l *BigDataLog) setProperty(key string, value interface{}) {
+	l.copyProperties()
+	l.Properties[key] = value
+}
+
+// deleteProperty 删除自定义属性, 不会修改调用方传入的 map
+func (l *BigDataLog) deleteProperty(key string) {
+	if _, ok := l.Properties[key]; !ok {
+		return
+	}
+	l.copyProperties()
+	delete(l.Properties, key)
+}
+
+// setProperties 替换自定义属性, own 表示 properties 是否为 SDK 内部创建
+func (l *BigDataLog) setProperties(properties map[string]interface{}, own bool) {
+	if l.ownProperties {
+		putProperties(l.Properties)
+	}
+	l.Properties = properties
+	l.ownProperties = own
+}
+
+// copyProperties 将调用方传入的属性复制一份, 之后可以安全修改
+func (l *BigDataLog) copyProperties() {
+	if l.ownProperties {
+		return
+	}
+	properties := newProperties()
+	for k, v := range l.Properties {
+		properties[k] = v
+	}
+	l.Properties = properties
+	l.ownProperties = true
 }
 
+// TrackInterface 上报接口, 由 *Client 实现
+// Producer 批量上报时, 传给自定义实现的 ReqTrack.Data 为独立的副本, Track 返回后可以继续持有
 type TrackInterface interface {
 	Track(track *ReqTrack) (int, error)
 }
@@ -0,0 +1,265 @@
+// Copyright (c) 2022. Homeland Interactive Technology Ltd. All rights reserved.
+
+package ruixuego
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"sync"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+const (
+	batchEncoderBufferSize = 4096 // 编码缓冲大小, 超过后写入压缩流
+	insertionSortMaxLen    = 16   // 属性数不超过该值时使用插入排序, 避免 sort.Strings 的内存分配
+)
+
+var batchEncoderPool = sync.Pool{
+	New: func() interface{} {
+		e := &batchEncoder{}
+		e.stream = jsoniter.NewStream(json, &e.counter, batchEncoderBufferSize)
+		return e
+	},
+}
+
+// batchEncoder 将一批埋点数据编码为 JSON 数组, 输出与 MarshalJSON 一致
+// 埋点字段及常见类型的属性值直接写入, 其他类型的属性值使用反射编码
+type batchEncoder struct {
+	counter countingWriter
+	stream  *jsoniter.Stream
+	keys    []string // 属性 key 排序使用, 嵌套的 map 依次追加在后面
+}
+
+// encodeBatch 将一批数据编码为 JSON 并经 codec 压缩后流式写入 w, 返回压缩前的字节数
+func encodeBatch(w io.Writer, codec Codec, batch []*BigDataLog) (int, error) {
+	cw, err := codec.NewWriter(w)
+	if err != nil {
+		return 0, err
+	}
+
+	e := batchEncoderPool.Get().(*batchEncoder)
+	e.counter.w, e.counter.n = cw, 0
+	e.stream.Reset(&e.counter)
+	e.stream.Error = nil
+	e.writeLogs(batch)
+	err = e.stream.Flush()
+	if err == nil {
+		err = e.stream.Error
+	}
+	n := e.counter.n
+	e.counter.w = nil
+	batchEncoderPool.Put(e)
+
+	if cerr := cw.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+// DecodeTrack 解码一次 Track 上报的埋点数据, 按 ReqTrack.Encoding 解压, 用于测试或自定义 TrackInterface
+func DecodeTrack(track *ReqTrack) ([]*BigDataLog, error) {
+	codec, err := codecForEncoding(track.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	r, err := codec.NewReader(bytes.NewReader(track.Data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var logs []*BigDataLog
+	err = json.NewDecoder(r).Decode(&logs)
+	if err != nil {
+		return nil, err
+	}
+	return logs, nil
+}
+
+func (e *batchEncoder) writeLogs(logs []*BigDataLog) {
+	stream := e.stream
+	if logs == nil {
+		stream.WriteNil()
+		return
+	}
+	stream.WriteRaw("[")
+	for i, logData := range logs {
+		if i > 0 {
+			stream.WriteRaw(",")
+		}
+		e.writeLog(logData)
+		if stream.Buffered() >= batchEncoderBufferSize {
+			if stream.Flush() != nil {
+				return
+			}
+		}
+	}
+	stream.WriteRaw("]")
+}
+
+// writeLog 按 BigDataLog 的字段顺序与 json tag 写入
+func (e *batchEncoder) writeLog(l *BigDataLog) {
+	stream := e.stream
+	if l == nil {
+		stream.WriteNil()
+		return
+	}
+	stream.WriteRaw(`{"type":`)
+	stream.WriteStringWithHTMLEscaped(l.Type)
+	stream.WriteRaw(`,"time":`)
+	stream.WriteStringWithHTMLEscaped(l.Time)
+	stream.WriteRaw(`,"distinct_id":`)
+	stream.WriteStringWithHTMLEscaped(l.DistinctID)
+	stream.WriteRaw(`,"devicecode":`)
+	stream.WriteStringWithHTMLEscaped(l.Devicecode)
+	stream.WriteRaw(`,"event":`)
+	stream.WriteStringWithHTMLEscaped(l.Event)
+	stream.WriteRaw(`,"uuid":`)
+	stream.WriteStringWithHTMLEscaped(l.UUID)
+	if l.IP != "" {
+		stream.WriteRaw(`,"ip":`)
+		stream.WriteStringWithHTMLEscaped(l.IP)
+	}
+	stream.WriteRaw(`,"properties":`)
+	e.writeMap(l.Properties)
+	if l.ProductID != "" {
+		stream.WriteRaw(`,"product_id":`)
+		stream.WriteStringWithHTMLEscaped(l.ProductID)
+	}
+	if l.ChannelID != "" {
+		stream.WriteRaw(`,"channel_id":`)
+		stream.WriteStringWithHTMLEscaped(l.ChannelID)
+	}
+	if l.SubChannelID != "" {
+		stream.WriteRaw(`,"sub_channel_id":`)
+		stream.WriteStringWithHTMLEscaped(l.SubChannelID)
+	}
+	stream.WriteRaw(`,"cpid":`)
+	stream.WriteUint32(l.CPID)
+	stream.WriteRaw(`,"platform_id":`)
+	stream.WriteInt32(l.PlatformID)
+	stream.WriteRaw("}")
+}
+
+// writeMap 按 key 排序写入 map, 与 MarshalJSON 一致
+func (e *batchEncoder) writeMap(m map[string]interface{}) {
+	stream := e.stream
+	if m == nil {
+		stream.WriteNil()
+		return
+	}
+	start := len(e.keys)
+	for k := range m {
+		e.keys = append(e.keys, k)
+	}
+	sortKeys(e.keys[start:])
+
+	stream.WriteRaw("{")
+	for i, n := 0, len(m); i < n; i++ {
+		// 写入嵌套 map 时 e.keys 可能扩容, 每次通过下标重新读取
+		k := e.keys[start+i]
+		if i > 0 {
+			stream.WriteRaw(",")
+		}
+		stream.WriteStringWithHTMLEscaped(k)
+		stream.WriteRaw(":")
+		e.writeValue(m[k])
+	}
+	stream.WriteRaw("}")
+
+	for i := start; i < len(e.keys); i++ {
+		e.keys[i] = ""
+	}
+	e.keys = e.keys[:start]
+}
+
+func (e *batchEncoder) writeValue(v interface{}) {
+	stream := e.stream
+	switch t := v.(type) {
+	case nil:
+		stream.WriteNil()
+	case string:
+		stream.WriteStringWithHTMLEscaped(t)
+	case bool:
+		stream.WriteBool(t)
+	case int:
+		stream.WriteInt(t)
+	case int8:
+		stream.WriteInt8(t)
+	case int16:
+		stream.WriteInt16(t)
+	case int32:
+		stream.WriteInt32(t)
+	case int64:
+		stream.WriteInt64(t)
+	case uint:
+		stream.WriteUint(t)
+	case uint8:
+		stream.WriteUint8(t)
+	case uint16:
+		stream.WriteUint16(t)
+	case uint32:
+		stream.WriteUint32(t)
+	case uint64:
+		stream.WriteUint64(t)
+	case float32:
+		stream.WriteFloat32(t)
+	case float64:
+		stream.WriteFloat64(t)
+	case map[string]interface{}:
+		e.writeMap(t)
+	case []interface{}:
+		if t == nil {
+			stream.WriteNil()
+			return
+		}
+		stream.WriteRaw("[")
+		for i, item := range t {
+			if i > 0 {
+				stream.WriteRaw(",")
+			}
+			e.writeValue(item)
+		}
+		stream.WriteRaw("]")
+	case []string:
+		if t == nil {
+			stream.WriteNil()
+			return
+		}
+		stream.WriteRaw("[")
+		for i, item := range t {
+			if i > 0 {
+				stream.WriteRaw(",")
+			}
+			stream.WriteStringWithHTMLEscaped(item)
+		}
+		stream.WriteRaw("]")
+	default:
+		stream.WriteVal(v)
+	}
+}
+
+func sortKeys(keys []string) {
+	if len(keys) > insertionSortMaxLen {
+		sort.Strings(keys)
+		return
+	}
+	for i := 1; i < len(keys); i++ {
+		for j := i; j > 0 && keys[j] < keys[j-1]; j-- {
+			keys[j], keys[j-1] = keys[j-1], keys[j]
+		}
+	}
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += n
+	return n, err
+}
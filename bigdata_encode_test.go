@@ -0,0 +1,190 @@
+// Copyright (c) 2022. Homeland Interactive Technology Ltd. All rights reserved.
+
+package ruixuego
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/ruixueyun/ruixuego/bufferpool"
+)
+
+const benchmarkBatchSize = 20
+
+func benchmarkLogs(n int) []*BigDataLog {
+	logs := make([]*BigDataLog, n)
+	for i := range logs {
+		logs[i] = &BigDataLog{
+			Type:       typeTrack,
+			Time:       "2022-04-15 13:20:00.123",
+			DistinctID: fmt.Sprintf("openid-%d", i),
+			Devicecode: "5f0c4e3a-0d7b-4a43-9b8e-3c1d2b0a9f11",
+			Event:      "match_end",
+			UUID:       fmt.Sprintf("2b4c0e5e-6a1f-4c8a-9d3e-%012d", i),
+			IP:         "10.0.0.1",
+			Properties: map[string]interface{}{
+				"match_id": "m-10086",
+				"rank":     i % 10,
+				"score":    1024.5,
+				"win":      i%2 == 0,
+				"heroes":   []string{"<a>", "b&c"},
+				"extra":    map[string]interface{}{"map": "arena", "mode": 3, "ratio": []interface{}{0.1, 1e21, 1e-7, float32(0.3)}},
+				"at":       time.Unix(1650000000, 0).UTC(),
+			},
+			ProductID: "p-1",
+			ChannelID: "c-1",
+			CPID:      1,
+			// 覆盖需要转义的字符
+			SubChannelID: "中文\"\n",
+			PlatformID:   10,
+		}
+	}
+	return logs
+}
+
+// TestEncodeBatch 确认各压缩编码下 encodeBatch 的输出解压后与 MarshalJSON 一致
+func TestEncodeBatch(t *testing.T) {
+	nested := benchmarkLogs(2)
+	nilProps := &BigDataLog{Type: typeTrack, Event: "nil", Devicecode: "d"}
+	emptyProps := &BigDataLog{Type: typeTrack, Event: "empty", Devicecode: "d", Properties: map[string]interface{}{}}
+	escape := &BigDataLog{
+		Type:       typeTrack,
+		Event:      "escape\"<tag>&",
+		Devicecode: "d\t\r\n\x01",
+		Properties: map[string]interface{}{
+			"html":      "<script>alert('x')</script>&amp;",
+			"quote":     `"\\/`,
+			"control":   "\x00\x1f\x7f",
+			"separator": "\u2028\u2029",
+			"unicode":   "中文 😀",
+			"key\"<>":   map[string]interface{}{"a&b": []interface{}{"\n", nil, map[string]interface{}{}}},
+		},
+	}
+	cases := map[string][]*BigDataLog{
+		"nested":     nested,
+		"nil":        {nilProps},
+		"empty":      {emptyProps},
+		"escape":     {escape},
+		"mixed":      {nilProps, emptyProps, escape, nested[0]},
+		"empty list": {},
+	}
+
+	for _, compression := range []string{CompressionNone, CompressionGzip, CompressionZstd, CompressionBrotli} {
+		codec, err := NewCodec(compression, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, logs := range cases {
+			want, err := MarshalJSON(logs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf := &bytes.Buffer{}
+			n, err := encodeBatch(buf, codec, logs)
+			if err != nil {
+				t.Fatalf("%s/%s: %v", compression, name, err)
+			}
+			r, err := codec.NewReader(buf)
+			if err != nil {
+				t.Fatalf("%s/%s: %v", compression, name, err)
+			}
+			got, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatalf("%s/%s: %v", compression, name, err)
+			}
+			if n != len(got) || !bytes.Equal(got, want) {
+				t.Errorf("%s/%s: encodeBatch mismatch, n=%d\n got: %s\nwant: %s", compression, name, n, got, want)
+			}
+		}
+	}
+}
+
+func TestNewCodecLevel(t *testing.T) {
+	cases := []struct {
+		compression string
+		level       int
+		valid       bool
+	}{
+		{CompressionGzip, 9, true},
+		{CompressionGzip, 10, false},
+		{CompressionZstd, 1, true},
+		{CompressionZstd, 22, true},
+		{CompressionZstd, -1, false},
+		{CompressionZstd, 23, false},
+		{CompressionBrotli, 11, true},
+		{CompressionBrotli, 12, false},
+	}
+	for _, c := range cases {
+		_, err := NewCodec(c.compression, c.level)
+		if c.valid && err != nil {
+			t.Errorf("%s level %d: %v", c.compression, c.level, err)
+		}
+		if !c.valid && !errors.Is(err, ErrInvalidParam) {
+			t.Errorf("%s level %d: got %v, want ErrInvalidParam", c.compression, c.level, err)
+		}
+	}
+}
+
+// BenchmarkEncodeBatchMarshal 原上报路径: MarshalJSON 后再 GzipCompressV2
+func BenchmarkEncodeBatchMarshal(b *testing.B) {
+	logs := benchmarkLogs(benchmarkBatchSize)
+	data, _ := MarshalJSON(logs)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		data, err := MarshalJSON(logs)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, err = GzipCompressV2(data)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkEncodeBatchMarshalNone 原编码方式, 不压缩
+func BenchmarkEncodeBatchMarshalNone(b *testing.B) {
+	logs := benchmarkLogs(benchmarkBatchSize)
+	data, _ := MarshalJSON(logs)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := MarshalJSON(logs)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkEncodeBatch 流式编码到 bufferpool 的缓冲, 并直接写入压缩流
+func BenchmarkEncodeBatch(b *testing.B) {
+	for _, compression := range []string{CompressionNone, CompressionGzip, CompressionZstd, CompressionBrotli} {
+		b.Run(compression, func(b *testing.B) {
+			codec, err := NewCodec(compression, 0)
+			if err != nil {
+				b.Fatal(err)
+			}
+			logs := benchmarkLogs(benchmarkBatchSize)
+			data, _ := MarshalJSON(logs)
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				buf := bufferpool.Get()
+				_, err := encodeBatch(buf, codec, logs)
+				bufferpool.Put(buf)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2022. Homeland Interactive Technology Ltd. All rights reserved.
+
+package ruixuego
+
+import (
+	"fmt"
+	"hash/fnv"
+	"path"
+)
+
+const sampleRateScale = 10000 // 采样率精度, 万分之一
+
+// SampleRule 事件采样规则, 只对事件生效, 用户属性操作 (user_set 等) 不采样
+type SampleRule struct {
+	Event string  `json:"event"` // 事件名, 支持 path.Match 通配符, 如 battle_*
+	Rate  float64 `json:"rate"`  // 采样率, 取值 [0, 1], 小于等于 0 时丢弃所有匹配的事件
+}
+
+// EventHook 事件钩子, 在事件进入缓冲区前调用
+// 返回 false 表示丢弃该事件. 钩子内可以直接修改 logData, 但不能在钩子返回后继续持有它
+type EventHook func(logData *BigDataLog) bool
+
+// checkFilter 检查事件过滤配置是否合法
+func (conf *BigDataConfig) checkFilter() error {
+	patterns := make([]string, 0, len(conf.AllowEvents)+len(conf.DenyEvents)+len(conf.SampleRules))
+	patterns = append(patterns, conf.AllowEvents...)
+	patterns = append(patterns, conf.DenyEvents...)
+	for _, rule := range conf.SampleRules {
+		if rule == nil {
+			return fmt.Errorf("%w: empty sample rule", ErrInvalidParam)
+		}
+		patterns = append(patterns, rule.Event)
+	}
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%w: event pattern %q: %s", ErrInvalidParam, pattern, err.Error())
+		}
+	}
+	return nil
+}
+
+// filter 按黑白名单、采样规则及钩子过滤事件, 返回 false 表示丢弃
+func (conf *BigDataConfig) filter(logData *BigDataLog) bool {
+	if len(conf.AllowEvents) > 0 && !matchEvent(conf.AllowEvents, logData.Event) {
+		return false
+	}
+	if matchEvent(conf.DenyEvents, logData.Event) {
+		return false
+	}
+	if !conf.sample(logData) {
+		return false
+	}
+
+	if conf.EventHook != nil {
+		logData.copyProperties()
+		return conf.EventHook(logData)
+	}
+	return true
+}
+
+// sample 按第一条匹配的采样规则采样, 返回 false 表示丢弃
+// 被采样的事件会在 PropertyKeySampleRate 属性中记录采样率; 用户属性操作不采样, 避免丢失用户属性更新或写入采样率
+func (conf *BigDataConfig) sample(logData *BigDataLog) bool {
+	if logData.Type == typeUser {
+		return true
+	}
+	for _, rule := range conf.SampleRules {
+		if ok, _ := path.Match(rule.Event, logData.Event); !ok {
+			continue
+		}
+		if rule.Rate >= 1 {
+			return true
+		}
+		if !sampled(logData, rule.Rate) {
+			return false
+		}
+		logData.setProperty(PropertyKeySampleRate, rule.Rate)
+		return true
+	}
+	return true
+}
+
+func matchEvent(patterns []string, event string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, event); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// sampled 按 DistinctID 哈希确定性采样, 同一用户的采样结果总是相同
+// DistinctID 为空时使用 Devicecode
+func sampled(logData *BigDataLog, rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	id := logData.DistinctID
+	if id == "" {
+		id = logData.Devicecode
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(id))
+	return h.Sum32()%sampleRateScale < uint32(rate*sampleRateScale)
+}
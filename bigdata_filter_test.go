@@ -0,0 +1,44 @@
+// Copyright (c) 2022. Homeland Interactive Technology Ltd. All rights reserved.
+
+package ruixuego
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSampleSkipsUserOperations(t *testing.T) {
+	p, w := newTestProducer(t, &BigDataConfig{SampleRules: []*SampleRule{{Event: "*", Rate: 0.5}}})
+	for i := 0; i < 100; i++ {
+		distinctID := fmt.Sprintf("u%d", i)
+		if err := p.Tracks("d", distinctID, SetEvent("login")); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Tracks("d", distinctID, SetUserSet(map[string]interface{}{"level": i})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.Close()
+
+	events, users := 0, 0
+	for _, logData := range w.written() {
+		_, hasRate := logData.Properties[PropertyKeySampleRate]
+		if logData.Type == typeUser {
+			users++
+			if hasRate {
+				t.Errorf("user operation has %s", PropertyKeySampleRate)
+			}
+			continue
+		}
+		events++
+		if !hasRate {
+			t.Errorf("sampled event has no %s", PropertyKeySampleRate)
+		}
+	}
+	if users != 100 {
+		t.Errorf("got %d user operations, want 100", users)
+	}
+	if events == 0 || events == 100 {
+		t.Errorf("got %d sampled events, want some of 100", events)
+	}
+}
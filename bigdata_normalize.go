@@ -0,0 +1,324 @@
+// Copyright (c) 2022. Homeland Interactive Technology Ltd. All rights reserved.
+
+package ruixuego
+
+import (
+	"encoding/base64"
+	jsonen "encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+	"unicode/utf8"
+)
+
+const normalizeDefaultSeparator = "."
+
+// NormalizePolicy 属性不符合规范时的处理方式
+type NormalizePolicy string
+
+const (
+	NormalizePolicyString   NormalizePolicy = "string"   // 转换为字符串, 仅用于不支持的类型
+	NormalizePolicyTruncate NormalizePolicy = "truncate" // 截断, 仅用于超出长度或数量限制
+	NormalizePolicyDrop     NormalizePolicy = "drop"     // 丢弃该属性
+	NormalizePolicyReject   NormalizePolicy = "reject"   // 拒绝整个事件, 返回 ErrInvalidProperty
+)
+
+// NormalizeConfig 自定义属性规范化配置, 在事件校验之后, 过滤与上报之前执行
+//
+//	time.Time 按 BigDataConfig 的时间格式与时区转换为字符串
+//	[]byte 转换为字符串, 不是合法 UTF-8 时使用 base64 编码
+//	自定义数值类型转换为对应的基础数值类型, 结构体转换为 map, 规则见 StructProperties
+//	chan, func, complex 等不支持的类型按 Unsupported 处理
+type NormalizeConfig struct {
+	Flatten         bool            `json:"flatten"`           // 是否将嵌套的 map 展开为一层, 如 {"a":{"b":1}} 展开为 {"a.b":1}
+	Separator       string          `json:"separator"`         // 展开嵌套 map 时 key 的分隔符, 默认 "."
+	Unsupported     NormalizePolicy `json:"unsupported"`       // 不支持的类型的处理方式: string, drop, reject, 默认 string
+	MaxProperties   int             `json:"max_properties"`    // 最多属性数, 为 0 时不限制
+	MaxKeyLength    int             `json:"max_key_length"`    // key 最大长度 (字符数), 只限制第一层及展开后的 key, 为 0 时不限制
+	MaxStringLength int             `json:"max_string_length"` // 字符串属性值最大长度 (字符数), 为 0 时不限制
+	Overflow        NormalizePolicy `json:"overflow"`          // 超出限制时的处理方式: truncate, drop, reject, 默认 truncate
+}
+
+func (conf *NormalizeConfig) check() error {
+	if conf.Separator == "" {
+		conf.Separator = normalizeDefaultSeparator
+	}
+	switch conf.Unsupported {
+	case "":
+		conf.Unsupported = NormalizePolicyString
+	case NormalizePolicyString, NormalizePolicyDrop, NormalizePolicyReject:
+	default:
+		return fmt.Errorf("%w: normalize unsupported policy %q", ErrInvalidParam, conf.Unsupported)
+	}
+	switch conf.Overflow {
+	case "":
+		conf.Overflow = NormalizePolicyTruncate
+	case NormalizePolicyTruncate, NormalizePolicyDrop, NormalizePolicyReject:
+	default:
+		return fmt.Errorf("%w: normalize overflow policy %q", ErrInvalidParam, conf.Overflow)
+	}
+	return nil
+}
+
+// normalizer 对一个事件的属性做规范化
+type normalizer struct {
+	conf  *BigDataConfig
+	nconf *NormalizeConfig
+	event string
+}
+
+// normalize 规范化事件的自定义属性, 规范化后的属性写入 SDK 创建的 map, 不会修改调用方传入的 map
+func (conf *BigDataConfig) normalize(logData *BigDataLog) error {
+	if conf.Normalize == nil || len(logData.Properties) == 0 {
+		return nil
+	}
+	n := &normalizer{conf: conf, nconf: conf.Normalize, event: logData.Event}
+
+	properties := newProperties()
+	err := n.normalizeMap(properties, logData.Properties)
+	if err == nil {
+		err = n.limitCount(properties)
+	}
+	if err != nil {
+		putProperties(properties)
+		return err
+	}
+	logData.setProperties(properties, true)
+	return nil
+}
+
+func (n *normalizer) normalizeMap(dst, src map[string]interface{}) error {
+	if !n.nconf.Flatten && n.nconf.MaxKeyLength <= 0 {
+		for k, v := range src {
+			err := n.normalizeProperty(dst, k, v)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// 展开或截断后 key 可能重复, 按 key 顺序处理保证结果是确定的
+	keys := make([]string, 0, len(src))
+	for k := range src {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		err := n.normalizeProperty(dst, k, src[k])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *normalizer) normalizeProperty(dst map[string]interface{}, key string, v interface{}) error {
+	value, ok, err := n.normalizeValue(key, v)
+	if err != nil || !ok {
+		return err
+	}
+	if m, isMap := value.(map[string]interface{}); isMap && n.nconf.Flatten {
+		return n.normalizeFlatMap(dst, key, m)
+	}
+
+	key, ok, err = n.limitKey(key)
+	if err != nil || !ok {
+		return err
+	}
+	if _, exists := dst[key]; exists {
+		// 截断或展开后 key 重复时保留先写入的属性
+		return nil
+	}
+	dst[key] = value
+	return nil
+}
+
+// normalizeFlatMap 将已规范化的嵌套 map 按 key 顺序展开写入 dst
+func (n *normalizer) normalizeFlatMap(dst map[string]interface{}, prefix string, m map[string]interface{}) error {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		key := prefix + n.nconf.Separator + k
+		if sub, ok := m[k].(map[string]interface{}); ok {
+			err := n.normalizeFlatMap(dst, key, sub)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		key, ok, err := n.limitKey(key)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if _, exists := dst[key]; !exists {
+			dst[key] = m[k]
+		}
+	}
+	return nil
+}
+
+// normalizeValue 将属性值转换为上报支持的类型, 返回 false 表示丢弃该属性
+func (n *normalizer) normalizeValue(key string, v interface{}) (interface{}, bool, error) {
+	switch t := v.(type) {
+	case nil, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, jsonen.Number:
+		return v, true, nil
+	case string:
+		return n.limitString(key, t)
+	case []byte:
+		if utf8.Valid(t) {
+			return n.limitString(key, string(t))
+		}
+		return n.limitString(key, base64.StdEncoding.EncodeToString(t))
+	case time.Time:
+		s, err := n.conf.formatTime(t)
+		return s, err == nil, err
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, item := range t {
+			value, ok, err := n.normalizeValue(key+n.nconf.Separator+k, item)
+			if err != nil {
+				return nil, false, err
+			}
+			if ok {
+				m[k] = value
+			}
+		}
+		return m, true, nil
+	case []interface{}:
+		list := make([]interface{}, 0, len(t))
+		for _, item := range t {
+			value, ok, err := n.normalizeValue(key, item)
+			if err != nil {
+				return nil, false, err
+			}
+			if ok {
+				list = append(list, value)
+			}
+		}
+		return list, true, nil
+	}
+	return n.normalizeReflect(key, reflect.ValueOf(v))
+}
+
+func (n *normalizer) normalizeReflect(key string, rv reflect.Value) (interface{}, bool, error) {
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			return nil, true, nil
+		}
+		return n.normalizeValue(key, rv.Elem().Interface())
+	case reflect.String:
+		return n.limitString(key, rv.String())
+	case reflect.Bool:
+		return rv.Bool(), true, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), true, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return rv.Uint(), true, nil
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true, nil
+	case reflect.Struct:
+		if rv.Type() == timeType {
+			return n.normalizeValue(key, rv.Interface())
+		}
+		return n.normalizeValue(key, structToMap(rv))
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			break
+		}
+		if rv.IsNil() {
+			return nil, true, nil
+		}
+		m := make(map[string]interface{}, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			m[iter.Key().String()] = iter.Value().Interface()
+		}
+		return n.normalizeValue(key, m)
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			return nil, true, nil
+		}
+		list := make([]interface{}, rv.Len())
+		for i := range list {
+			list[i] = rv.Index(i).Interface()
+		}
+		return n.normalizeValue(key, list)
+	}
+
+	switch n.nconf.Unsupported {
+	case NormalizePolicyDrop:
+		return nil, false, nil
+	case NormalizePolicyReject:
+		return nil, false, fmt.Errorf("%w: event %s property %s unsupported type %s", ErrInvalidProperty, n.event, key, rv.Type())
+	}
+	return n.limitString(key, fmt.Sprint(rv.Interface()))
+}
+
+func (n *normalizer) limitKey(key string) (string, bool, error) {
+	max := n.nconf.MaxKeyLength
+	if max <= 0 || utf8.RuneCountInString(key) <= max {
+		return key, true, nil
+	}
+	switch n.nconf.Overflow {
+	case NormalizePolicyDrop:
+		return "", false, nil
+	case NormalizePolicyReject:
+		return "", false, fmt.Errorf("%w: event %s property key %s longer than %d", ErrInvalidProperty, n.event, key, max)
+	}
+	return truncateString(key, max), true, nil
+}
+
+func (n *normalizer) limitString(key, s string) (interface{}, bool, error) {
+	max := n.nconf.MaxStringLength
+	if max <= 0 || utf8.RuneCountInString(s) <= max {
+		return s, true, nil
+	}
+	switch n.nconf.Overflow {
+	case NormalizePolicyDrop:
+		return nil, false, nil
+	case NormalizePolicyReject:
+		return nil, false, fmt.Errorf("%w: event %s property %s longer than %d", ErrInvalidProperty, n.event, key, max)
+	}
+	return truncateString(s, max), true, nil
+}
+
+// limitCount 属性数超出限制时按 key 排序保留前 MaxProperties 个属性
+func (n *normalizer) limitCount(properties map[string]interface{}) error {
+	max := n.nconf.MaxProperties
+	if max <= 0 || len(properties) <= max {
+		return nil
+	}
+	if n.nconf.Overflow == NormalizePolicyReject {
+		return fmt.Errorf("%w: event %s has %d properties, more than %d", ErrInvalidProperty, n.event, len(properties), max)
+	}
+	keys := make([]string, 0, len(properties))
+	for k := range properties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys[max:] {
+		delete(properties, k)
+	}
+	return nil
+}
+
+// truncateString 截断为最多 max 个字符, 不会截断多字节字符
+func truncateString(s string, max int) string {
+	i := 0
+	for pos := range s {
+		if i == max {
+			return s[:pos]
+		}
+		i++
+	}
+	return s
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2022. Homeland Interactive Technology Ltd. All rights reserved.
+
+package ruixuego
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// propertiesPoolMaxLen 超过该长度的属性 map 不放回对象池, 避免对象池持有过大的 map
+const propertiesPoolMaxLen = 256
+
+var (
+	logPool        = sync.Pool{New: func() interface{} { return &BigDataLog{} }}
+	propertiesPool = sync.Pool{New: func() interface{} { return make(map[string]interface{}) }}
+)
+
+// newBigDataLog 从对象池获取埋点数据, 引用计数为 1
+// 由 Producer 交给内置的 LogWriter 后, 写出或丢弃时调用 release 放回对象池
+func newBigDataLog() *BigDataLog {
+	logData := logPool.Get().(*BigDataLog)
+	logData.refs = 1
+	return logData
+}
+
+// release 引用计数减 1, 为 0 时将埋点数据及 SDK 创建的属性 map 放回对象池
+// 非对象池创建的埋点数据引用计数为 0, 调用 release 没有影响
+func (l *BigDataLog) release() {
+	if l == nil || atomic.AddInt32(&l.refs, -1) != 0 {
+		return
+	}
+	if l.ownProperties {
+		putProperties(l.Properties)
+	}
+	*l = BigDataLog{}
+	logPool.Put(l)
+}
+
+// retain 引用计数加 1, 用于同一条数据交给多个 LogWriter 或 Sink, 每个持有者各自调用 release
+// 非对象池创建的埋点数据不计数
+func (l *BigDataLog) retain() {
+	if atomic.LoadInt32(&l.refs) > 0 {
+		atomic.AddInt32(&l.refs, 1)
+	}
+}
+
+func releaseLogs(logs []*BigDataLog) {
+	for _, logData := range logs {
+		logData.release()
+	}
+}
+
+func newProperties() map[string]interface{} {
+	return propertiesPool.Get().(map[string]interface{})
+}
+
+func putProperties(m map[string]interface{}) {
+	if m == nil || len(m) > propertiesPoolMaxLen {
+		return
+	}
+	for k := range m {
+		delete(m, k)
+	}
+	propertiesPool.Put(m)
+}
@@ -0,0 +1,324 @@
+// Copyright (c) 2022. Homeland Interactive Technology Ltd. All rights reserved.
+
+package ruixuego
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// RedactAction 敏感属性的处理方式
+type RedactAction string
+
+const (
+	RedactActionMask RedactAction = "mask" // 脱敏, 保留首尾部分字符, 其余替换为 *
+	RedactActionHash RedactAction = "hash" // 使用 RedactConfig.Salt 计算 HMAC-SHA256, 替换为十六进制字符串
+	RedactActionDrop RedactAction = "drop" // 丢弃该属性
+)
+
+const (
+	// RedactPatternMobile 中国大陆手机号
+	RedactPatternMobile = `(?:^|[^0-9])(1[3-9][0-9]{9})(?:$|[^0-9])`
+	// RedactPatternIDCard 中国大陆 18 位身份证号
+	RedactPatternIDCard = `(?:^|[^0-9])([1-9][0-9]{5}(?:18|19|20)[0-9]{2}(?:0[1-9]|1[0-2])(?:0[1-9]|[12][0-9]|3[01])[0-9]{3}[0-9Xx])(?:$|[^0-9Xx])`
+
+	redactDropped = "[REDACTED]" // 日志中被丢弃的内容
+)
+
+// RedactRule 敏感属性规则, Key, KeyPattern, ValuePattern 至少设置一个
+//
+//	Key, KeyPattern 匹配属性名 (包括嵌套 map 中的 key), 处理整个属性值;
+//	开启 NormalizeConfig.Flatten 时也匹配展开后 key 的最后一段, 如 Key 为 "phone" 时匹配 "user.phone"
+//	ValuePattern 匹配字符串属性值, mask 与 hash 只替换匹配的部分, drop 丢弃整个属性;
+//	正则中有分组时只替换第一个分组, 如 RedactPatternMobile
+type RedactRule struct {
+	Key          string       `json:"key"`           // 属性名
+	KeyPattern   string       `json:"key_pattern"`   // 属性名正则
+	ValuePattern string       `json:"value_pattern"` // 属性值正则, 如 RedactPatternMobile, RedactPatternIDCard
+	Action       RedactAction `json:"action"`        // 处理方式: mask, hash, drop, 默认 mask
+	keyRe        *regexp.Regexp
+	valueRe      *regexp.Regexp
+}
+
+// RedactMobile 手机号规则
+func RedactMobile(action RedactAction) *RedactRule {
+	return &RedactRule{ValuePattern: RedactPatternMobile, Action: action}
+}
+
+// RedactIDCard 身份证号规则
+func RedactIDCard(action RedactAction) *RedactRule {
+	return &RedactRule{ValuePattern: RedactPatternIDCard, Action: action}
+}
+
+// RedactConfig 敏感属性处理配置
+// 在属性规范化与过滤之后, 写入缓冲之前执行, EventHook 添加或修改的属性同样会被处理;
+// EventHook 看到的是处理前的属性, DryRun 及所有输出目标都只能看到处理后的属性;
+// ValuePattern 规则同时用于上报失败时输出的数据日志
+type RedactConfig struct {
+	Rules     []*RedactRule `json:"rules"` // 规则, 按顺序使用第一条匹配属性名的规则, 之后依次应用所有 ValuePattern 规则
+	Salt      string        `json:"-"`     // hash 使用的密钥, 有 hash 规则时不能为空
+	separator string        // 开启 NormalizeConfig.Flatten 时展开 key 使用的分隔符
+}
+
+func (conf *RedactConfig) check() error {
+	for i, rule := range conf.Rules {
+		if rule == nil || rule.Key == "" && rule.KeyPattern == "" && rule.ValuePattern == "" {
+			return fmt.Errorf("%w: redact rule %d has no key or pattern", ErrInvalidParam, i)
+		}
+		switch rule.Action {
+		case "":
+			rule.Action = RedactActionMask
+		case RedactActionHash:
+			if conf.Salt == "" {
+				return fmt.Errorf("%w: redact rule %d uses hash without salt", ErrInvalidParam, i)
+			}
+		case RedactActionMask, RedactActionDrop:
+		default:
+			return fmt.Errorf("%w: redact action %q", ErrInvalidParam, rule.Action)
+		}
+		var err error
+		if rule.KeyPattern != "" {
+			rule.keyRe, err = regexp.Compile(rule.KeyPattern)
+			if err != nil {
+				return fmt.Errorf("%w: redact key pattern %s: %s", ErrInvalidParam, rule.KeyPattern, err.Error())
+			}
+		}
+		if rule.ValuePattern != "" {
+			rule.valueRe, err = regexp.Compile(rule.ValuePattern)
+			if err != nil {
+				return fmt.Errorf("%w: redact value pattern %s: %s", ErrInvalidParam, rule.ValuePattern, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+func (rule *RedactRule) matchKey(key string) bool {
+	if rule.Key != "" && rule.Key == key {
+		return true
+	}
+	return rule.keyRe != nil && rule.keyRe.MatchString(key)
+}
+
+// matchKey 返回第一条匹配属性名的规则, 展开后的 key 依次匹配完整的 key 与最后一段
+func (rc *RedactConfig) matchKey(key string) *RedactRule {
+	last := ""
+	if rc.separator != "" {
+		if i := strings.LastIndex(key, rc.separator); i >= 0 {
+			last = key[i+len(rc.separator):]
+		}
+	}
+	for _, rule := range rc.Rules {
+		if rule.matchKey(key) || last != "" && rule.matchKey(last) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// redact 处理事件的敏感属性, 有修改时写入 SDK 创建的 map, 不会修改调用方传入的 map
+func (conf *BigDataConfig) redact(logData *BigDataLog) {
+	rc := conf.Redact
+	if rc == nil || len(rc.Rules) == 0 || len(logData.Properties) == 0 {
+		return
+	}
+	var properties map[string]interface{}
+	for k, v := range logData.Properties {
+		value, changed, keep := rc.redactProperty(k, v)
+		if !changed {
+			continue
+		}
+		if properties == nil {
+			logData.copyProperties()
+			properties = logData.Properties
+		}
+		if keep {
+			properties[k] = value
+		} else {
+			delete(properties, k)
+		}
+	}
+}
+
+// redactProperty 返回处理后的属性值, 是否修改, 以及是否保留该属性
+func (rc *RedactConfig) redactProperty(key string, v interface{}) (interface{}, bool, bool) {
+	if rule := rc.matchKey(key); rule != nil {
+		switch rule.Action {
+		case RedactActionDrop:
+			return nil, true, false
+		case RedactActionHash:
+			return rc.hash(valueString(v)), true, true
+		}
+		return maskString(valueString(v)), true, true
+	}
+
+	switch t := v.(type) {
+	case string:
+		return rc.redactString(t)
+	case map[string]interface{}:
+		var m map[string]interface{}
+		for k, item := range t {
+			value, changed, keep := rc.redactProperty(k, item)
+			if !changed {
+				continue
+			}
+			if m == nil {
+				// 嵌套 map 可能属于调用方, 有修改时复制一份
+				m = make(map[string]interface{}, len(t))
+				for k, item := range t {
+					m[k] = item
+				}
+			}
+			if keep {
+				m[k] = value
+			} else {
+				delete(m, k)
+			}
+		}
+		if m == nil {
+			return v, false, true
+		}
+		return m, true, true
+	case []interface{}:
+		var list []interface{}
+		for i, item := range t {
+			value, changed, keep := rc.redactProperty(key, item)
+			if changed && list == nil {
+				list = make([]interface{}, 0, len(t))
+				list = append(list, t[:i]...)
+			}
+			if list != nil && keep {
+				list = append(list, value)
+			}
+		}
+		if list == nil {
+			return v, false, true
+		}
+		return list, true, true
+	case []string:
+		var list []string
+		for i, item := range t {
+			value, changed, keep := rc.redactString(item)
+			if changed && list == nil {
+				list = make([]string, 0, len(t))
+				list = append(list, t[:i]...)
+			}
+			if list != nil && keep {
+				list = append(list, value.(string))
+			}
+		}
+		if list == nil {
+			return v, false, true
+		}
+		return list, true, true
+	}
+	return v, false, true
+}
+
+// redactString 依次应用 ValuePattern 规则
+func (rc *RedactConfig) redactString(s string) (interface{}, bool, bool) {
+	changed := false
+	for _, rule := range rc.Rules {
+		if rule.valueRe == nil || !rule.valueRe.MatchString(s) {
+			continue
+		}
+		if rule.Action == RedactActionDrop {
+			return nil, true, false
+		}
+		s = rc.replace(rule, s)
+		changed = true
+	}
+	return s, changed, true
+}
+
+// replace 将 s 中匹配规则的部分替换为脱敏或 hash 后的值, drop 规则替换为 [REDACTED]
+func (rc *RedactConfig) replace(rule *RedactRule, s string) string {
+	var sb strings.Builder
+	last := 0
+	// 从上次替换的结尾继续匹配, 使分组外用于定界的字符可以被相邻的下一次匹配使用
+	for last <= len(s) {
+		loc := rule.valueRe.FindStringSubmatchIndex(s[last:])
+		if loc == nil {
+			break
+		}
+		start, end := last+loc[0], last+loc[1]
+		if len(loc) >= 4 && loc[2] >= 0 {
+			start, end = last+loc[2], last+loc[3]
+		}
+		if end == start {
+			// 空匹配不替换, 避免死循环
+			if end == len(s) {
+				break
+			}
+			_, size := utf8.DecodeRuneInString(s[end:])
+			sb.WriteString(s[last : end+size])
+			last = end + size
+			continue
+		}
+		sb.WriteString(s[last:start])
+		switch rule.Action {
+		case RedactActionHash:
+			sb.WriteString(rc.hash(s[start:end]))
+		case RedactActionDrop:
+			sb.WriteString(redactDropped)
+		default:
+			sb.WriteString(maskString(s[start:end]))
+		}
+		last = end
+	}
+	sb.WriteString(s[last:])
+	return sb.String()
+}
+
+// redactLog 对日志中输出的数据应用 ValuePattern 规则
+func (conf *BigDataConfig) redactLog(b []byte) string {
+	s := string(b)
+	rc := conf.Redact
+	if rc == nil {
+		return s
+	}
+	for _, rule := range rc.Rules {
+		if rule.valueRe != nil {
+			s = rc.replace(rule, s)
+		}
+	}
+	return s
+}
+
+func (rc *RedactConfig) hash(s string) string {
+	h := hmac.New(sha256.New, []byte(rc.Salt))
+	h.Write([]byte(s))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func valueString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, err := MarshalJSON(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+// maskString 脱敏, 7 个字符以上保留前 3 后 4 个字符, 如 138****8000, 较短时保留首尾各 1 个字符
+func maskString(s string) string {
+	n := utf8.RuneCountInString(s)
+	head, tail := 1, 1
+	switch {
+	case n <= 1:
+		return strings.Repeat("*", n)
+	case n == 2:
+		tail = 0
+	case n > 7:
+		head, tail = 3, 4
+	}
+	runes := []rune(s)
+	return string(runes[:head]) + strings.Repeat("*", n-head-tail) + string(runes[n-tail:])
+}
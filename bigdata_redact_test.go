@@ -0,0 +1,140 @@
+// Copyright (c) 2022. Homeland Interactive Technology Ltd. All rights reserved.
+
+package ruixuego
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+)
+
+func TestRedactHashRequiresSalt(t *testing.T) {
+	rc := &RedactConfig{Rules: []*RedactRule{{Key: "phone", Action: RedactActionHash}}}
+	if err := rc.check(); !errors.Is(err, ErrInvalidParam) {
+		t.Errorf("got %v, want ErrInvalidParam", err)
+	}
+	rc.Salt = "salt"
+	if err := rc.check(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRedactPatterns(t *testing.T) {
+	cases := []struct {
+		pattern string
+		s       string
+		want    string
+	}{
+		{RedactPatternMobile, "13812345678", "13812345678"},
+		{RedactPatternMobile, "tel:19912345678.", "19912345678"},
+		{RedactPatternMobile, "手机13812345678号", "13812345678"},
+		{RedactPatternMobile, "12812345678", ""},
+		{RedactPatternMobile, "1381234567", ""},
+		{RedactPatternMobile, "138123456789", ""},
+		{RedactPatternMobile, "013812345678", ""},
+		{RedactPatternIDCard, "11010519491231002X", "11010519491231002X"},
+		{RedactPatternIDCard, "id=110105200001010021;", "110105200001010021"},
+		{RedactPatternIDCard, "11010519491231002x", "11010519491231002x"},
+		{RedactPatternIDCard, "110105194913310021", ""},
+		{RedactPatternIDCard, "110105194912320021", ""},
+		{RedactPatternIDCard, "110105170001010021", ""},
+		{RedactPatternIDCard, "01010519491231002X", ""},
+		{RedactPatternIDCard, "11010519491231002", ""},
+		{RedactPatternIDCard, "1101051949123100211", ""},
+		{RedactPatternIDCard, "11010519491231002XX", ""},
+	}
+	for _, c := range cases {
+		m := regexp.MustCompile(c.pattern).FindStringSubmatch(c.s)
+		got := ""
+		if m != nil {
+			got = m[1]
+		}
+		if got != c.want {
+			t.Errorf("%q: got %q, want %q", c.s, got, c.want)
+		}
+	}
+}
+
+func TestRedactReplaceAdjacent(t *testing.T) {
+	rc := &RedactConfig{Rules: []*RedactRule{RedactMobile(RedactActionMask)}}
+	if err := rc.check(); err != nil {
+		t.Fatal(err)
+	}
+	rule := rc.Rules[0]
+	cases := map[string]string{
+		"13812345678,13912345678":         "138****5678,139****5678",
+		"13812345678 13912345678 ":        "138****5678 139****5678 ",
+		"a13812345678b13912345678c":       "a138****5678b139****5678c",
+		"1381234567813912345678":          "1381234567813912345678",
+		"13812345678,13912345678,1":       "138****5678,139****5678,1",
+		"中13812345678中13912345678中":       "中138****5678中139****5678中",
+		"13812345678,,13912345678,,1":     "138****5678,,139****5678,,1",
+		"no mobile":                       "no mobile",
+		"13812345678":                     "138****5678",
+		"13812345678\n13912345678\n15012": "138****5678\n139****5678\n15012",
+	}
+	for s, want := range cases {
+		if got := rc.replace(rule, s); got != want {
+			t.Errorf("%q: got %q, want %q", s, got, want)
+		}
+	}
+
+	rc = &RedactConfig{Rules: []*RedactRule{RedactMobile(RedactActionHash)}, Salt: "salt"}
+	if err := rc.check(); err != nil {
+		t.Fatal(err)
+	}
+	want := rc.hash("13812345678") + "," + rc.hash("13912345678")
+	if got := rc.replace(rc.Rules[0], "13812345678,13912345678"); got != want {
+		t.Errorf("hash: got %q, want %q", got, want)
+	}
+}
+
+// TestRedactAfterHookAndFlatten EventHook 添加的属性与展开后的 key 同样被处理
+func TestRedactAfterHookAndFlatten(t *testing.T) {
+	var hooked interface{}
+	p, w := newTestProducer(t, &BigDataConfig{
+		Normalize: &NormalizeConfig{Flatten: true},
+		Redact: &RedactConfig{Rules: []*RedactRule{
+			{Key: "phone"},
+			{KeyPattern: "^token$", Action: RedactActionDrop},
+			RedactMobile(RedactActionMask),
+		}},
+		EventHook: func(logData *BigDataLog) bool {
+			hooked = logData.Properties["user.phone"]
+			logData.Properties["contact"] = "tel 13912345678"
+			logData.Properties["token"] = "secret"
+			return true
+		},
+	})
+	err := p.Event("e").Device("d").
+		Prop("user", map[string]interface{}{"phone": "13812345678", "token": "secret", "name": "n"}).Send()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+
+	// EventHook 看到的是处理前的属性
+	if hooked != "13812345678" {
+		t.Errorf("hook: got %v", hooked)
+	}
+	logs := w.written()
+	if len(logs) != 1 {
+		t.Fatalf("got %d logs, want 1", len(logs))
+	}
+	props := logs[0].Properties
+	want := map[string]interface{}{
+		"user.phone": "138****5678",
+		"user.name":  "n",
+		"contact":    "tel 139****5678",
+	}
+	for k, v := range want {
+		if props[k] != v {
+			t.Errorf("%s: got %v, want %v", k, props[k], v)
+		}
+	}
+	for _, k := range []string{"user.token", "token"} {
+		if _, ok := props[k]; ok {
+			t.Errorf("%s: want dropped", k)
+		}
+	}
+}
@@ -0,0 +1,356 @@
+// Copyright (c) 2022. Homeland Interactive Technology Ltd. All rights reserved.
+
+package ruixuego
+
+import (
+	jsonen "encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PropertyType 事件属性值类型
+type PropertyType int
+
+const (
+	PropertyTypeAny    PropertyType = iota // 任意类型
+	PropertyTypeString                     // 字符串
+	PropertyTypeNumber                     // 整数或浮点数
+	PropertyTypeBool                       // 布尔值
+	PropertyTypeTime                       // time.Time 或时间字符串
+	PropertyTypeList                       // 切片或数组
+	PropertyTypeObject                     // map 或结构体
+)
+
+func (t PropertyType) String() string {
+	switch t {
+	case PropertyTypeAny:
+		return "any"
+	case PropertyTypeString:
+		return "string"
+	case PropertyTypeNumber:
+		return "number"
+	case PropertyTypeBool:
+		return "bool"
+	case PropertyTypeTime:
+		return "time"
+	case PropertyTypeList:
+		return "list"
+	case PropertyTypeObject:
+		return "object"
+	}
+	return "unknown"
+}
+
+// SchemaMode 事件校验模式
+type SchemaMode int
+
+const (
+	// SchemaModeStrict 严格模式, 校验不通过的事件直接拒绝上报
+	SchemaModeStrict SchemaMode = iota
+
+	// SchemaModeLenient 宽松模式, 校验不通过时记录日志并剔除不合规的属性
+	SchemaModeLenient
+)
+
+// PropertySchema 事件属性定义
+type PropertySchema struct {
+	Name     string        // 属性名
+	Type     PropertyType  // 属性值类型
+	Required bool          // 是否必填
+	Enum     []interface{} // 可选值列表, 为空时不限制; list 与 object 类型不支持
+}
+
+// EventSchema 事件定义
+type EventSchema struct {
+	Name       string            // 事件名, 用户属性操作使用 UserSet 等操作名
+	Types      []string          // 允许的埋点类型, 为空时只允许 BigDataTypeTrack
+	Properties []*PropertySchema // 属性定义
+	AllowExtra bool              // 是否允许上报未声明的属性
+}
+
+type eventSchema struct {
+	name       string
+	types      map[string]struct{}
+	properties map[string]*PropertySchema
+	required   []string
+	allowExtra bool
+}
+
+// SchemaRegistry 事件定义注册表
+// 配置到 BigDataConfig.Schema 后, Producer.Tracks 与 Client.SyncTrack 会按注册的定义校验事件
+// 只校验调用方设置的属性, 在合并公共属性 (SetSuperProperties) 之前进行
+type SchemaRegistry struct {
+	mode          SchemaMode
+	rejectUnknown bool
+	mutex         sync.RWMutex
+	events        map[string]*eventSchema
+}
+
+// NewSchemaRegistry 创建事件定义注册表
+//
+//	mode 校验模式
+//	rejectUnknown 是否拒绝未注册的事件, 宽松模式下只记录日志
+func NewSchemaRegistry(mode SchemaMode, rejectUnknown bool) *SchemaRegistry {
+	return &SchemaRegistry{
+		mode:          mode,
+		rejectUnknown: rejectUnknown,
+		events:        make(map[string]*eventSchema),
+	}
+}
+
+// Register 注册事件定义, 同名事件会被覆盖
+func (r *SchemaRegistry) Register(schemas ...*EventSchema) error {
+	compiled := make([]*eventSchema, 0, len(schemas))
+	for _, schema := range schemas {
+		es, err := compileEventSchema(schema)
+		if err != nil {
+			return err
+		}
+		compiled = append(compiled, es)
+	}
+
+	r.mutex.Lock()
+	for _, es := range compiled {
+		r.events[es.name] = es
+	}
+	r.mutex.Unlock()
+	return nil
+}
+
+// Unregister 删除事件定义
+func (r *SchemaRegistry) Unregister(event string) {
+	r.mutex.Lock()
+	delete(r.events, event)
+	r.mutex.Unlock()
+}
+
+func compileEventSchema(schema *EventSchema) (*eventSchema, error) {
+	if schema == nil || schema.Name == "" {
+		return nil, ErrInvalidEvent
+	}
+	es := &eventSchema{
+		name:       schema.Name,
+		types:      make(map[string]struct{}, len(schema.Types)),
+		properties: make(map[string]*PropertySchema, len(schema.Properties)),
+		allowExtra: schema.AllowExtra,
+	}
+	for _, typ := range schema.Types {
+		switch typ {
+		case typeTrack, typeUpdateTrack, typeFirstTrack, typeUser:
+			es.types[typ] = struct{}{}
+		default:
+			return nil, fmt.Errorf("%w: event %s declares type %q", ErrInvalidType, schema.Name, typ)
+		}
+	}
+	if len(es.types) == 0 {
+		es.types[typeTrack] = struct{}{}
+	}
+	for _, prop := range schema.Properties {
+		if prop == nil || prop.Name == "" {
+			return nil, fmt.Errorf("%w: event %s declares empty property", ErrInvalidProperty, schema.Name)
+		}
+		if _, ok := presetKeys[prop.Name]; ok {
+			return nil, fmt.Errorf("%w: event %s declares preset key %s", ErrInvalidProperty, schema.Name, prop.Name)
+		}
+		if len(prop.Enum) > 0 && (prop.Type == PropertyTypeList || prop.Type == PropertyTypeObject) {
+			return nil, fmt.Errorf("%w: event %s property %s of type %s can not declare enum",
+				ErrInvalidProperty, schema.Name, prop.Name, prop.Type)
+		}
+		for _, v := range prop.Enum {
+			if !matchPropertyType(prop.Type, v) {
+				return nil, fmt.Errorf("%w: event %s property %s enum value %v is not %s",
+					ErrInvalidProperty, schema.Name, prop.Name, v, prop.Type)
+			}
+		}
+		es.properties[prop.Name] = prop
+		if prop.Required {
+			es.required = append(es.required, prop.Name)
+		}
+	}
+	return es, nil
+}
+
+// validate 校验事件, 宽松模式下会剔除不合规的属性
+func (r *SchemaRegistry) validate(logData *BigDataLog) error {
+	if r == nil {
+		return nil
+	}
+
+	r.mutex.RLock()
+	es := r.events[logData.Event]
+	r.mutex.RUnlock()
+
+	if es == nil {
+		if r.rejectUnknown {
+			err := fmt.Errorf("%w: %s", ErrUnknownEvent, logData.Event)
+			if r.mode == SchemaModeStrict {
+				return err
+			}
+			logger.Errorf("bigdata schema: %s", err.Error())
+		}
+	} else if _, ok := es.types[logData.Type]; !ok {
+		err := fmt.Errorf("%w: event %s does not allow type %s", ErrInvalidType, logData.Event, logData.Type)
+		if r.mode == SchemaModeStrict {
+			return err
+		}
+		logger.Errorf("bigdata schema: %s", err.Error())
+	}
+
+	for key, value := range logData.Properties {
+		reason := es.checkProperty(key, value)
+		if reason == "" {
+			continue
+		}
+		err := fmt.Errorf("%w: event %s property %s %s", ErrInvalidProperty, logData.Event, key, reason)
+		if r.mode == SchemaModeStrict {
+			return err
+		}
+		logger.Errorf("bigdata schema: %s, stripped", err.Error())
+		logData.deleteProperty(key)
+	}
+
+	if es == nil {
+		return nil
+	}
+	for _, key := range es.required {
+		if _, ok := logData.Properties[key]; ok {
+			continue
+		}
+		err := fmt.Errorf("%w: event %s property %s is required", ErrInvalidProperty, logData.Event, key)
+		if r.mode == SchemaModeStrict {
+			return err
+		}
+		logger.Errorf("bigdata schema: %s", err.Error())
+	}
+	return nil
+}
+
+// checkProperty 校验单个属性, 返回不合规的原因, 合规时返回空字符串
+// es 为空表示事件未注册, 此时只检查预置 Key
+func (es *eventSchema) checkProperty(key string, value interface{}) string {
+	if _, ok := presetKeys[key]; ok {
+		return "is a reserved preset key, use SetPreset instead"
+	}
+	if es == nil {
+		return ""
+	}
+
+	prop, ok := es.properties[key]
+	if !ok {
+		if es.allowExtra && !strings.HasPrefix(key, "$") {
+			return ""
+		}
+		return "is not declared"
+	}
+	if !matchPropertyType(prop.Type, value) {
+		return fmt.Sprintf("must be %s, got %T", prop.Type, value)
+	}
+	if len(prop.Enum) > 0 && !enumContains(prop.Enum, value) {
+		return fmt.Sprintf("value %v is not in enum", value)
+	}
+	return ""
+}
+
+func matchPropertyType(t PropertyType, v interface{}) bool {
+	switch t {
+	case PropertyTypeAny:
+		return true
+	case PropertyTypeString:
+		_, ok := v.(string)
+		return ok
+	case PropertyTypeNumber:
+		_, ok := toFloat64(v)
+		return ok
+	case PropertyTypeBool:
+		_, ok := v.(bool)
+		return ok
+	case PropertyTypeTime:
+		switch v.(type) {
+		case time.Time, *time.Time, string:
+			return true
+		}
+		return false
+	case PropertyTypeList:
+		if v == nil {
+			return false
+		}
+		k := reflect.TypeOf(v).Kind()
+		return k == reflect.Slice || k == reflect.Array
+	case PropertyTypeObject:
+		if v == nil {
+			return false
+		}
+		rt := reflect.TypeOf(v)
+		if rt.Kind() == reflect.Ptr {
+			rt = rt.Elem()
+		}
+		return rt.Kind() == reflect.Map || rt.Kind() == reflect.Struct
+	}
+	return false
+}
+
+// enumContains 数值按 float64 比较, 其他类型使用 reflect.DeepEqual, 避免比较 slice, map 等不可比较类型时 panic
+func enumContains(enum []interface{}, v interface{}) bool {
+	f, isNumber := toFloat64(v)
+	for _, e := range enum {
+		if isNumber {
+			if ef, ok := toFloat64(e); ok && ef == f {
+				return true
+			}
+			continue
+		}
+		if reflect.DeepEqual(e, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// toFloat64 将数值类型 (含自定义数值类型) 转换为 float64
+func toFloat64(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	case jsonen.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case nil, string, bool:
+		return 0, false
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2022. Homeland Interactive Technology Ltd. All rights reserved.
+
+package ruixuego
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSchemaRejectsEnumOnListAndObject(t *testing.T) {
+	for _, typ := range []PropertyType{PropertyTypeList, PropertyTypeObject} {
+		r := NewSchemaRegistry(SchemaModeStrict, false)
+		err := r.Register(&EventSchema{
+			Name:       "e",
+			Properties: []*PropertySchema{{Name: "v", Type: typ, Enum: []interface{}{[]interface{}{1}}}},
+		})
+		if !errors.Is(err, ErrInvalidProperty) {
+			t.Errorf("%s enum: got %v, want ErrInvalidProperty", typ, err)
+		}
+	}
+}
+
+func TestSchemaEnumUncomparableValues(t *testing.T) {
+	r := NewSchemaRegistry(SchemaModeStrict, false)
+	err := r.Register(&EventSchema{
+		Name: "e",
+		Properties: []*PropertySchema{{Name: "v", Type: PropertyTypeAny, Enum: []interface{}{
+			"a", []interface{}{"x", "y"}, map[string]interface{}{"k": "v"},
+		}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		value interface{}
+		ok    bool
+	}{
+		{"a", true},
+		{[]interface{}{"x", "y"}, true},
+		{map[string]interface{}{"k": "v"}, true},
+		{[]interface{}{"x"}, false},
+		{map[string]interface{}{"k": "w"}, false},
+		{"b", false},
+	}
+	for _, c := range cases {
+		logData := &BigDataLog{Type: typeTrack, Event: "e", Properties: map[string]interface{}{"v": c.value}}
+		err := r.validate(logData)
+		if (err == nil) != c.ok {
+			t.Errorf("value %v: got error %v, want ok=%v", c.value, err, c.ok)
+		}
+	}
+}
+
+func TestSchemaIgnoresSuperProperties(t *testing.T) {
+	r := NewSchemaRegistry(SchemaModeStrict, true)
+	err := r.Register(&EventSchema{
+		Name:       "login",
+		Properties: []*PropertySchema{{Name: "level", Type: PropertyTypeNumber, Required: true}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, w := newTestProducer(t, &BigDataConfig{Schema: r})
+	p.SetSuperProperties(map[string]interface{}{"server_version": "1.0.0"})
+	p.SetSuperPropertiesProvider(func() map[string]interface{} {
+		return map[string]interface{}{"online": 10}
+	})
+
+	if err := p.Tracks("d", "u", SetEvent("login"), SetProperties(map[string]interface{}{"level": 3})); err != nil {
+		t.Fatal(err)
+	}
+	// 调用方设置的属性仍然需要校验
+	err = p.Tracks("d", "u", SetEvent("login"), SetProperties(map[string]interface{}{"level": 3, "extra": 1}))
+	if !errors.Is(err, ErrInvalidProperty) {
+		t.Errorf("undeclared property: got %v, want ErrInvalidProperty", err)
+	}
+	p.Close()
+
+	logs := w.written()
+	if len(logs) != 1 {
+		t.Fatalf("got %d logs, want 1", len(logs))
+	}
+	props := logs[0].Properties
+	if props["server_version"] != "1.0.0" || props["online"] != 10 || props["level"] != 3 {
+		t.Errorf("got properties %v", props)
+	}
+}
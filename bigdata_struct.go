@@ -0,0 +1,267 @@
+// Copyright (c) 2022. Homeland Interactive Technology Ltd. All rights reserved.
+
+package ruixuego
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// structTagName 结构体转换为埋点属性时使用的 tag 名
+//
+//	`ruixue:"name"`           属性名为 name
+//	`ruixue:"name,omitempty"` 字段为零值时不上报
+//	`ruixue:"-"`              忽略该字段
+//
+// 没有 tag 的字段使用字段名作为属性名, 没有 tag 的匿名结构体字段会展开到外层
+const structTagName = "ruixue"
+
+var (
+	structInfoCache sync.Map // map[reflect.Type]*structInfo
+	timeType        = reflect.TypeOf(time.Time{})
+)
+
+type structInfo struct {
+	fields []*structField
+}
+
+type structField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+// StructProperties 将结构体转换为埋点自定义属性
+// v 必须为结构体或结构体指针, 嵌套结构体转换为嵌套的 map, time.Time 保持原值
+// 通过 SetStructProperties, TrackStruct 或 EventBuilder.Struct 上报时, time.Time 按 BigDataConfig 的 TimeFormat 与 TimeZone 格式化
+func StructProperties(v interface{}) (map[string]interface{}, error) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil, fmt.Errorf("%w: struct properties is nil", ErrInvalidParam)
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct || rv.Type() == timeType {
+		return nil, fmt.Errorf("%w: struct properties must be a struct, got %T", ErrInvalidParam, v)
+	}
+	return structToMap(rv), nil
+}
+
+// SetStructProperties 使用结构体设置自定义属性, 转换规则见 StructProperties
+func SetStructProperties(v interface{}) BigdataOptions {
+	return func(logData *BigDataLog) error {
+		properties, err := StructProperties(v)
+		if err != nil {
+			return err
+		}
+		logData.setProperties(properties, true)
+		logData.structTimes = true
+		return nil
+	}
+}
+
+// TrackStruct 使用结构体作为自定义属性上报埋点事件, 转换规则见 StructProperties
+//
+//	devicecode 设备码
+//	distinctID 用户标识, 通常为瑞雪 OpenID
+//	event 事件名
+//	v 自定义属性结构体
+//	opts 其他埋点参数设置, 如 SetPreset
+func (p *Producer) TrackStruct(devicecode, distinctID, event string, v interface{}, opts ...BigdataOptions) error {
+	return p.Event(event).Device(devicecode).User(distinctID).Struct(v).Options(opts...).Send()
+}
+
+// SyncTrackStruct 同步接口 使用结构体作为自定义属性直接将埋点数据上报给瑞雪云, 转换规则见 StructProperties
+func (c *Client) SyncTrackStruct(devicecode, distinctID, event string, v interface{}, opts ...BigdataOptions) error {
+	return c.SyncTrack(devicecode, distinctID, structOptions(event, v, opts)...)
+}
+
+func structOptions(event string, v interface{}, opts []BigdataOptions) []BigdataOptions {
+	ret := make([]BigdataOptions, 0, len(opts)+2)
+	ret = append(ret, SetEvent(event), SetStructProperties(v))
+	return append(ret, opts...)
+}
+
+func getStructInfo(t reflect.Type) *structInfo {
+	if info, ok := structInfoCache.Load(t); ok {
+		return info.(*structInfo)
+	}
+	info := &structInfo{}
+	collectStructFields(t, nil, info, map[reflect.Type]bool{})
+	actual, _ := structInfoCache.LoadOrStore(t, info)
+	return actual.(*structInfo)
+}
+
+// collectStructFields 收集结构体字段, 展开匿名结构体字段, 外层字段优先
+func collectStructFields(t reflect.Type, index []int, info *structInfo, visited map[reflect.Type]bool) {
+	if visited[t] {
+		return
+	}
+	visited[t] = true
+
+	var embedded []reflect.StructField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get(structTagName)
+		if tag == "-" {
+			continue
+		}
+		name, opts := tag, ""
+		if idx := strings.IndexByte(tag, ','); idx >= 0 {
+			name, opts = tag[:idx], tag[idx+1:]
+		}
+
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && name == "" && ft.Kind() == reflect.Struct && ft != timeType {
+			f.Index = append(append([]int{}, index...), i)
+			embedded = append(embedded, f)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if info.has(name) {
+			continue
+		}
+		info.fields = append(info.fields, &structField{
+			name:      name,
+			index:     append(append([]int{}, index...), i),
+			omitEmpty: hasTagOption(opts, "omitempty"),
+		})
+	}
+
+	for _, f := range embedded {
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		collectStructFields(ft, f.Index, info, visited)
+	}
+}
+
+func (info *structInfo) has(name string) bool {
+	for _, f := range info.fields {
+		if f.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func hasTagOption(opts, option string) bool {
+	for opts != "" {
+		var opt string
+		if idx := strings.IndexByte(opts, ','); idx >= 0 {
+			opt, opts = opts[:idx], opts[idx+1:]
+		} else {
+			opt, opts = opts, ""
+		}
+		if opt == option {
+			return true
+		}
+	}
+	return false
+}
+
+func structToMap(rv reflect.Value) map[string]interface{} {
+	info := getStructInfo(rv.Type())
+	ret := make(map[string]interface{}, len(info.fields))
+	for _, f := range info.fields {
+		fv, ok := fieldByIndex(rv, f.index)
+		if !ok {
+			// 匿名结构体指针为 nil, 其中的字段视为零值
+			continue
+		}
+		if f.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+		ret[f.name] = convertValue(fv)
+	}
+	return ret
+}
+
+// fieldByIndex 按 index 获取字段, 途经的匿名结构体指针为 nil 时返回 false
+func fieldByIndex(rv reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && rv.Kind() == reflect.Ptr {
+			if rv.IsNil() {
+				return reflect.Value{}, false
+			}
+			rv = rv.Elem()
+		}
+		rv = rv.Field(x)
+	}
+	return rv, true
+}
+
+func convertValue(rv reflect.Value) interface{} {
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			return nil
+		}
+		return convertValue(rv.Elem())
+	case reflect.Struct:
+		if rv.Type() == timeType {
+			return rv.Interface()
+		}
+		return structToMap(rv)
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			return nil
+		}
+		if !needConvert(rv.Type().Elem()) {
+			return rv.Interface()
+		}
+		list := make([]interface{}, rv.Len())
+		for i := range list {
+			list[i] = convertValue(rv.Index(i))
+		}
+		return list
+	case reflect.Map:
+		if rv.IsNil() {
+			return nil
+		}
+		if rv.Type().Key().Kind() != reflect.String || !needConvert(rv.Type().Elem()) {
+			return rv.Interface()
+		}
+		m := make(map[string]interface{}, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			m[iter.Key().String()] = convertValue(iter.Value())
+		}
+		return m
+	}
+	return rv.Interface()
+}
+
+// needConvert 该类型的值是否需要转换后才能作为埋点属性
+func needConvert(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Struct:
+		return true
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return needConvert(t.Elem())
+	}
+	return false
+}
+
+func isEmptyValue(rv reflect.Value) bool {
+	switch rv.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return rv.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return rv.IsNil()
+	}
+	return rv.IsZero()
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2022. Homeland Interactive Technology Ltd. All rights reserved.
+
+package ruixuego
+
+import (
+	"testing"
+	"time"
+)
+
+type testStructTime struct {
+	At    time.Time            `ruixue:"at"`
+	List  []time.Time          `ruixue:"list"`
+	Map   map[string]time.Time `ruixue:"map"`
+	Inner struct {
+		At *time.Time `ruixue:"at"`
+	} `ruixue:"inner"`
+}
+
+func TestStructTimeUsesConfigFormat(t *testing.T) {
+	at := time.Date(2022, 4, 15, 21, 20, 0, 0, time.FixedZone("CST", 8*3600))
+	v := &testStructTime{At: at, List: []time.Time{at}, Map: map[string]time.Time{"k": at}}
+	v.Inner.At = &at
+
+	p, w := newTestProducer(t, &BigDataConfig{TimeFormat: time.RFC3339, TimeZone: "UTC"})
+	if err := p.TrackStruct("d", "u", "e", v); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Event("e").Device("d").Struct(v).Send(); err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+
+	const want = "2022-04-15T13:20:00Z"
+	logs := w.written()
+	if len(logs) != 2 {
+		t.Fatalf("got %d logs, want 2", len(logs))
+	}
+	for _, logData := range logs {
+		props := logData.Properties
+		if props["at"] != want {
+			t.Errorf("at: got %v, want %s", props["at"], want)
+		}
+		if got := props["list"].([]interface{})[0]; got != want {
+			t.Errorf("list: got %v, want %s", got, want)
+		}
+		if got := props["map"].(map[string]interface{})["k"]; got != want {
+			t.Errorf("map: got %v, want %s", got, want)
+		}
+		if got := props["inner"].(map[string]interface{})["at"]; got != want {
+			t.Errorf("inner: got %v, want %s", got, want)
+		}
+	}
+}
+
+func TestStructPropertiesKeepsTime(t *testing.T) {
+	at := time.Unix(1650000000, 0)
+	props, err := StructProperties(testStructTime{At: at})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := props["at"].(time.Time); !ok || !got.Equal(at) {
+		t.Errorf("at: got %v, want %v", props["at"], at)
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright (c) 2022. Homeland Interactive Technology Ltd. All rights reserved.
+
+package ruixuego
+
+import (
+	"fmt"
+	"time"
+)
+
+// unixMilliThreshold 大于该值的 Unix 时间戳按毫秒处理, 否则按秒处理
+const unixMilliThreshold = 1e12
+
+func loadLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("%w: time zone %q: %s", ErrInvalidParam, name, err.Error())
+	}
+	return loc, nil
+}
+
+func (conf *BigDataConfig) timeFormat() string {
+	if conf == nil || conf.TimeFormat == "" {
+		return dateTimeFormat
+	}
+	return conf.TimeFormat
+}
+
+func (conf *BigDataConfig) timeLocation() *time.Location {
+	if conf == nil || conf.location == nil {
+		return time.Local
+	}
+	return conf.location
+}
+
+// resolveTime 将 SetPreset 传入的事件时间或自定义参数设置的 Time 转换为配置的格式与时区
+func (conf *BigDataConfig) resolveTime(logData *BigDataLog) error {
+	raw := logData.rawTime
+	if raw == nil && logData.Time != "" {
+		raw = logData.Time
+	}
+	t, err := conf.formatTime(raw)
+	if err != nil {
+		return err
+	}
+	logData.Time = t
+	logData.rawTime = nil
+	return nil
+}
+
+// formatTime 将事件时间转换为配置的格式与时区, v 为 nil 或空字符串时使用当前时间
+//
+//	支持 time.Time, *time.Time, Unix 时间戳 (秒或毫秒),
+//	以及配置的时间格式或 RFC3339 格式的字符串
+func (conf *BigDataConfig) formatTime(v interface{}) (string, error) {
+	t, err := conf.parseTime(v)
+	if err != nil {
+		return "", err
+	}
+	return t.In(conf.timeLocation()).Format(conf.timeFormat()), nil
+}
+
+// resolvePropertyTimes 将结构体转换得到的 time.Time 属性按配置的格式与时区转换为字符串
+// 嵌套的 map 与切片中有需要转换的值时复制后再修改, 不会修改调用方传入的数据
+func (conf *BigDataConfig) resolvePropertyTimes(logData *BigDataLog) {
+	if !logData.structTimes {
+		return
+	}
+	logData.structTimes = false
+	logData.copyProperties()
+	for k, v := range logData.Properties {
+		if value, ok := conf.formatTimeValue(v); ok {
+			logData.Properties[k] = value
+		}
+	}
+}
+
+// formatTimeValue 转换 v 中的 time.Time, 没有需要转换的值时返回 false
+func (conf *BigDataConfig) formatTimeValue(v interface{}) (interface{}, bool) {
+	switch t := v.(type) {
+	case time.Time:
+		return t.In(conf.timeLocation()).Format(conf.timeFormat()), true
+	case map[string]interface{}:
+		var m map[string]interface{}
+		for k, item := range t {
+			value, ok := conf.formatTimeValue(item)
+			if !ok {
+				continue
+			}
+			if m == nil {
+				m = make(map[string]interface{}, len(t))
+				for k, item := range t {
+					m[k] = item
+				}
+			}
+			m[k] = value
+		}
+		return m, m != nil
+	case []interface{}:
+		var list []interface{}
+		for i, item := range t {
+			value, ok := conf.formatTimeValue(item)
+			if !ok {
+				continue
+			}
+			if list == nil {
+				list = append([]interface{}(nil), t...)
+			}
+			list[i] = value
+		}
+		return list, list != nil
+	}
+	return v, false
+}
+
+func (conf *BigDataConfig) parseTime(v interface{}) (time.Time, error) {
+	switch t := v.(type) {
+	case nil:
+		return time.Now(), nil
+	case time.Time:
+		if t.IsZero() {
+			return time.Now(), nil
+		}
+		return t, nil
+	case *time.Time:
+		if t == nil || t.IsZero() {
+			return time.Now(), nil
+		}
+		return *t, nil
+	case string:
+		return conf.parseTimeString(t)
+	case int:
+		return unixTime(int64(t))
+	case int32:
+		return unixTime(int64(t))
+	case int64:
+		return unixTime(t)
+	case uint32:
+		return unixTime(int64(t))
+	case uint64:
+		return unixTime(int64(t))
+	case float64:
+		return unixTime(int64(t))
+	}
+	return time.Time{}, fmt.Errorf("%w: unsupported time type %T", ErrInvalidTime, v)
+}
+
+func (conf *BigDataConfig) parseTimeString(s string) (time.Time, error) {
+	if s == "" {
+		return time.Now(), nil
+	}
+	t, err := time.ParseInLocation(conf.timeFormat(), s, conf.timeLocation())
+	if err == nil {
+		return t, nil
+	}
+	t, err = time.Parse(time.RFC3339Nano, s)
+	if err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("%w: %q", ErrInvalidTime, s)
+}
+
+func unixTime(n int64) (time.Time, error) {
+	if n <= 0 {
+		return time.Time{}, fmt.Errorf("%w: unix timestamp %d", ErrInvalidTime, n)
+	}
+	if n > unixMilliThreshold {
+		return time.Unix(n/1e3, n%1e3*int64(time.Millisecond)), nil
+	}
+	return time.Unix(n, 0), nil
+}
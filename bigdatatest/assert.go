@@ -0,0 +1,92 @@
+// Copyright (c) 2022. Homeland Interactive Technology Ltd. All rights reserved.
+
+package bigdatatest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ruixueyun/ruixuego"
+)
+
+// TestingT 断言使用的测试接口, *testing.T 与 *testing.B 均实现了该接口
+type TestingT interface {
+	Helper()
+	Errorf(format string, args ...interface{})
+}
+
+// AssertEmitted 断言至少上报了一条事件名为 event 且包含 properties 中所有属性的数据
+func (r *Recorder) AssertEmitted(t TestingT, event string, properties map[string]interface{}) bool {
+	t.Helper()
+	if len(r.Find(event, properties)) > 0 {
+		return true
+	}
+	events := r.Events(event)
+	if len(events) == 0 {
+		t.Errorf("bigdatatest: event %s not emitted, emitted: %s", event, r.summary())
+		return false
+	}
+	t.Errorf("bigdatatest: event %s emitted %d times, none has properties %s, got: %s",
+		event, len(events), marshal(properties), marshal(events[len(events)-1].Properties))
+	return false
+}
+
+// AssertNotEmitted 断言没有上报事件名为 event 的数据
+func (r *Recorder) AssertNotEmitted(t TestingT, event string) bool {
+	t.Helper()
+	if n := r.Count(event); n > 0 {
+		t.Errorf("bigdatatest: event %s emitted %d times, want none", event, n)
+		return false
+	}
+	return true
+}
+
+// AssertCount 断言事件名为 event 的数据条数为 n
+func (r *Recorder) AssertCount(t TestingT, event string, n int) bool {
+	t.Helper()
+	if got := r.Count(event); got != n {
+		t.Errorf("bigdatatest: event %s emitted %d times, want %d", event, got, n)
+		return false
+	}
+	return true
+}
+
+// AssertTotal 断言上报的数据总条数为 n
+func (r *Recorder) AssertTotal(t TestingT, n int) bool {
+	t.Helper()
+	if got := len(r.Logs()); got != n {
+		t.Errorf("bigdatatest: %d events emitted, want %d: %s", got, n, r.summary())
+		return false
+	}
+	return true
+}
+
+// summary 按事件名输出条数, 用于断言失败的信息
+func (r *Recorder) summary() string {
+	counts := r.Counts()
+	if len(counts) == 0 {
+		return "none"
+	}
+	events := make([]string, 0, len(counts))
+	for event := range counts {
+		events = append(events, event)
+	}
+	sort.Strings(events)
+	var sb strings.Builder
+	for i, event := range events {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		fmt.Fprintf(&sb, "%s=%d", event, counts[event])
+	}
+	return sb.String()
+}
+
+func marshal(v interface{}) string {
+	b, err := ruixuego.MarshalJSON(v)
+	if err != nil {
+		return err.Error()
+	}
+	return string(b)
+}
@@ -0,0 +1,237 @@
+// Copyright (c) 2022. Homeland Interactive Technology Ltd. All rights reserved.
+
+// Package bigdatatest 提供测试埋点代码使用的 TrackInterface 实现
+//
+//	// 事件未设置 CPID 时使用全局配置中的 CPID, 需要先调用 Init
+//	ruixuego.Init(&ruixuego.Config{CPID: 1})
+//	rec := bigdatatest.NewRecorder()
+//	p, _ := ruixuego.NewProducer(rec, &ruixuego.BigDataConfig{BatchSize: 1})
+//	// 调用业务代码...
+//	p.Close()
+//	rec.AssertEmitted(t, "login", map[string]interface{}{"level": 10})
+//	rec.AssertCount(t, "login", 1)
+package bigdatatest
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ruixueyun/ruixuego"
+)
+
+// ErrSimulated 模拟的上报失败
+var ErrSimulated = errors.New("bigdatatest: simulated failure")
+
+// Batch 一次上报成功的数据
+type Batch struct {
+	Header  map[string]string      // 请求头, 如区域, 区服标识
+	TraceID string                 // 请求唯一标识
+	Logs    []*ruixuego.BigDataLog // 解码后的埋点数据
+}
+
+// Recorder 记录上报数据的 TrackInterface, 按 ReqTrack.Encoding 解压并解码每批数据
+// 可模拟上报失败, HTTP 状态码及延迟, 上报失败的批次不会被记录
+type Recorder struct {
+	mutex    sync.Mutex
+	batches  []*Batch
+	logs     []*ruixuego.BigDataLog
+	calls    int
+	failNext int
+	failCode int
+	failAll  bool
+	latency  time.Duration
+	notify   chan struct{} // 每次记录数据后关闭并重新创建, 用于 Wait
+}
+
+// NewRecorder 创建 Recorder
+func NewRecorder() *Recorder {
+	return &Recorder{notify: make(chan struct{})}
+}
+
+// Track 实现 ruixuego.TrackInterface
+func (r *Recorder) Track(track *ruixuego.ReqTrack) (int, error) {
+	r.mutex.Lock()
+	r.calls++
+	latency := r.latency
+	code, fail := http.StatusOK, false
+	switch {
+	case r.failNext > 0:
+		r.failNext--
+		code, fail = r.failCode, true
+	case r.failAll:
+		code, fail = r.failCode, true
+	}
+	r.mutex.Unlock()
+
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	if fail {
+		return code, fmt.Errorf("%w: [%d] %s", ErrSimulated, code, http.StatusText(code))
+	}
+
+	logs, err := ruixuego.DecodeTrack(track)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if track.LogCount != 0 && track.LogCount != len(logs) {
+		return http.StatusBadRequest, fmt.Errorf("bigdatatest: log count %d, decoded %d", track.LogCount, len(logs))
+	}
+	header := make(map[string]string, len(track.Header))
+	for k, v := range track.Header {
+		header[k] = v
+	}
+
+	r.mutex.Lock()
+	r.batches = append(r.batches, &Batch{Header: header, TraceID: track.TraceID, Logs: logs})
+	r.logs = append(r.logs, logs...)
+	close(r.notify)
+	r.notify = make(chan struct{})
+	r.mutex.Unlock()
+	return code, nil
+}
+
+// FailNext 之后 n 次上报失败并返回状态码 code
+func (r *Recorder) FailNext(n, code int) {
+	r.mutex.Lock()
+	r.failNext, r.failCode = n, code
+	r.mutex.Unlock()
+}
+
+// FailAll 之后所有上报失败并返回状态码 code, 直到调用 Recover
+func (r *Recorder) FailAll(code int) {
+	r.mutex.Lock()
+	r.failAll, r.failCode = true, code
+	r.mutex.Unlock()
+}
+
+// Recover 取消模拟失败
+func (r *Recorder) Recover() {
+	r.mutex.Lock()
+	r.failAll, r.failNext = false, 0
+	r.mutex.Unlock()
+}
+
+// SetLatency 每次上报的延迟
+func (r *Recorder) SetLatency(d time.Duration) {
+	r.mutex.Lock()
+	r.latency = d
+	r.mutex.Unlock()
+}
+
+// Reset 清空已记录的数据与调用次数, 不影响模拟失败与延迟的设置
+func (r *Recorder) Reset() {
+	r.mutex.Lock()
+	r.batches, r.logs, r.calls = nil, nil, 0
+	r.mutex.Unlock()
+}
+
+// Calls 返回 Track 调用次数, 包括模拟失败的调用
+func (r *Recorder) Calls() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.calls
+}
+
+// Batches 返回上报成功的批次
+func (r *Recorder) Batches() []*Batch {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]*Batch(nil), r.batches...)
+}
+
+// Logs 返回上报成功的所有埋点数据, 按上报顺序排列
+func (r *Recorder) Logs() []*ruixuego.BigDataLog {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]*ruixuego.BigDataLog(nil), r.logs...)
+}
+
+// Events 返回事件名为 event 的埋点数据
+func (r *Recorder) Events(event string) []*ruixuego.BigDataLog {
+	return r.Find(event, nil)
+}
+
+// Find 返回事件名为 event 且包含 properties 中所有属性的埋点数据, 属性值按 JSON 编码后比较
+func (r *Recorder) Find(event string, properties map[string]interface{}) []*ruixuego.BigDataLog {
+	var ret []*ruixuego.BigDataLog
+	for _, logData := range r.Logs() {
+		if logData.Event == event && HasProperties(logData, properties) {
+			ret = append(ret, logData)
+		}
+	}
+	return ret
+}
+
+// Count 返回事件名为 event 的埋点数据条数
+func (r *Recorder) Count(event string) int {
+	return len(r.Events(event))
+}
+
+// Counts 返回每个事件名的埋点数据条数
+func (r *Recorder) Counts() map[string]int {
+	ret := make(map[string]int)
+	for _, logData := range r.Logs() {
+		ret[logData.Event]++
+	}
+	return ret
+}
+
+// Wait 等待至少记录 n 条事件名为 event 的数据, event 为空时不限事件名, 超时返回 false
+// 用于 UploadWorkers 大于 1 等异步上报的场景
+func (r *Recorder) Wait(event string, n int, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		r.mutex.Lock()
+		count := 0
+		for _, logData := range r.logs {
+			if event == "" || logData.Event == event {
+				count++
+			}
+		}
+		notify := r.notify
+		r.mutex.Unlock()
+		if count >= n {
+			return true
+		}
+
+		select {
+		case <-notify:
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+// HasProperties 埋点数据是否包含 properties 中所有属性, 属性值按 JSON 编码后比较, 如 int 10 与 float64 10 相等
+func HasProperties(logData *ruixuego.BigDataLog, properties map[string]interface{}) bool {
+	for k, want := range properties {
+		got, ok := logData.Properties[k]
+		if !ok || !jsonEqual(got, want) {
+			return false
+		}
+	}
+	return true
+}
+
+func jsonEqual(a, b interface{}) bool {
+	ab, err := ruixuego.MarshalJSON(a)
+	if err != nil {
+		return false
+	}
+	bb, err := ruixuego.MarshalJSON(b)
+	if err != nil {
+		return false
+	}
+	var av, bv interface{}
+	if ruixuego.UnmarshalJSON(ab, &av) != nil || ruixuego.UnmarshalJSON(bb, &bv) != nil {
+		return false
+	}
+	ab, _ = ruixuego.MarshalJSON(av)
+	bb, _ = ruixuego.MarshalJSON(bv)
+	return string(ab) == string(bb)
+}
@@ -0,0 +1,162 @@
+// Copyright (c) 2022. Homeland Interactive Technology Ltd. All rights reserved.
+
+package bigdatatest
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ruixueyun/ruixuego"
+)
+
+// rawTrack 不压缩的上报数据
+func rawTrack(t *testing.T, events ...string) *ruixuego.ReqTrack {
+	t.Helper()
+	logs := make([]*ruixuego.BigDataLog, len(events))
+	for i, event := range events {
+		logs[i] = &ruixuego.BigDataLog{Type: ruixuego.BigDataTypeTrack, Event: event, Devicecode: "d"}
+	}
+	data, err := ruixuego.MarshalJSON(logs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ruixuego.ReqTrack{Data: data, LogCount: len(logs)}
+}
+
+func TestRecorderEncodings(t *testing.T) {
+	compressions := []string{
+		ruixuego.CompressionNone,
+		ruixuego.CompressionGzip,
+		ruixuego.CompressionZstd,
+		ruixuego.CompressionBrotli,
+	}
+	for _, compression := range compressions {
+		rec := NewRecorder()
+		p, err := ruixuego.NewProducer(rec, &ruixuego.BigDataConfig{BatchSize: 2, Compression: compression})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			err = p.Event("login").Device("d").User("u").CPID(1).
+				Prop("level", i).Prop("extra", map[string]interface{}{"name": "<a&b>"}).Send()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = p.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if n := len(rec.Batches()); n != 2 {
+			t.Errorf("%s: got %d batches, want 2", compression, n)
+		}
+		rec.AssertCount(t, "login", 3)
+		rec.AssertEmitted(t, "login", map[string]interface{}{
+			"level": 2,
+			"extra": map[string]interface{}{"name": "<a&b>"},
+		})
+	}
+}
+
+func TestRecorderFailures(t *testing.T) {
+	rec := NewRecorder()
+
+	rec.FailNext(2, http.StatusServiceUnavailable)
+	for i := 0; i < 2; i++ {
+		code, err := rec.Track(rawTrack(t, "e"))
+		if code != http.StatusServiceUnavailable || !errors.Is(err, ErrSimulated) {
+			t.Fatalf("FailNext call %d: got [%d] %v", i, code, err)
+		}
+	}
+	if code, err := rec.Track(rawTrack(t, "e")); code != http.StatusOK || err != nil {
+		t.Fatalf("after FailNext: got [%d] %v", code, err)
+	}
+
+	rec.FailAll(http.StatusInternalServerError)
+	for i := 0; i < 3; i++ {
+		code, err := rec.Track(rawTrack(t, "e"))
+		if code != http.StatusInternalServerError || !errors.Is(err, ErrSimulated) {
+			t.Fatalf("FailAll call %d: got [%d] %v", i, code, err)
+		}
+	}
+	rec.Recover()
+	if _, err := rec.Track(rawTrack(t, "e", "f")); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := rec.Calls(); n != 7 {
+		t.Errorf("got %d calls, want 7", n)
+	}
+	// 失败的调用不记录数据
+	if counts := rec.Counts(); counts["e"] != 2 || counts["f"] != 1 {
+		t.Errorf("got counts %v", counts)
+	}
+
+	track := rawTrack(t, "e")
+	track.LogCount = 2
+	if _, err := rec.Track(track); err == nil {
+		t.Error("want error for mismatched log count")
+	}
+}
+
+func TestRecorderWait(t *testing.T) {
+	rec := NewRecorder()
+	start := time.Now()
+	if rec.Wait("e", 1, 20*time.Millisecond) {
+		t.Fatal("Wait returned true without data")
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Errorf("Wait returned after %s, want timeout", d)
+	}
+
+	other, two := rawTrack(t, "other"), rawTrack(t, "e", "e")
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		rec.Track(other)
+		rec.Track(two)
+	}()
+	if !rec.Wait("e", 2, time.Second) {
+		t.Fatal("Wait timed out")
+	}
+	if rec.Wait("e", 3, 20*time.Millisecond) {
+		t.Error("Wait returned true with 2 events, want 3")
+	}
+	if !rec.Wait("", 3, time.Second) {
+		t.Error("Wait for any event timed out")
+	}
+}
+
+func TestHasProperties(t *testing.T) {
+	logData := &ruixuego.BigDataLog{Properties: map[string]interface{}{
+		"int":    float64(10),
+		"str":    "10",
+		"list":   []interface{}{float64(1), "a"},
+		"nested": map[string]interface{}{"a": float64(1), "b": []interface{}{true}},
+		"nil":    nil,
+	}}
+	cases := []struct {
+		properties map[string]interface{}
+		want       bool
+	}{
+		{nil, true},
+		{map[string]interface{}{"int": 10}, true},
+		{map[string]interface{}{"int": int64(10)}, true},
+		{map[string]interface{}{"int": 10.5}, false},
+		{map[string]interface{}{"int": "10"}, false},
+		{map[string]interface{}{"str": 10}, false},
+		{map[string]interface{}{"list": []interface{}{1, "a"}}, true},
+		{map[string]interface{}{"list": []int{1}}, false},
+		{map[string]interface{}{"nested": map[string]interface{}{"b": []bool{true}, "a": 1}}, true},
+		{map[string]interface{}{"nested": map[string]interface{}{"a": 1}}, false},
+		{map[string]interface{}{"nil": nil}, true},
+		{map[string]interface{}{"missing": nil}, false},
+		{map[string]interface{}{"int": 10, "str": "10"}, true},
+	}
+	for _, c := range cases {
+		if got := HasProperties(logData, c.properties); got != c.want {
+			t.Errorf("HasProperties(%v) = %v, want %v", c.properties, got, c.want)
+		}
+	}
+}
@@ -10,9 +10,12 @@ import (
 	url2 "net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/ruixueyun/ruixuego/bufferpool"
 	"github.com/valyala/fasthttp"
 )
 
@@ -106,6 +109,11 @@ type Client struct {
 	producer   *Producer
 }
 
+// GetProducer 获取大数据埋点 Producer, 未配置 BigData 时返回 nil
+func (c *Client) GetProducer() *Producer {
+	return c.producer
+}
+
 func (c *Client) GetProductID() string {
 	return config.ProductID
 }
@@ -142,8 +150,12 @@ func (c *Client) Close() error {
 }
 
 func (c *Client) getRequest(header *ReqHeader, withoutSign ...bool) (string, *fasthttp.Request) {
-	traceID, cpID, ts := uuid.New().String(),
-		strconv.FormatUint(uint64(config.CPID), 10),
+	return c.getRequestWithTraceID(uuid.New().String(), header, withoutSign...)
+}
+
+func (c *Client) getRequestWithTraceID(
+	traceID string, header *ReqHeader, withoutSign ...bool) (string, *fasthttp.Request) {
+	cpID, ts := strconv.FormatUint(uint64(config.CPID), 10),
 		strconv.FormatInt(time.Now().Unix(), 10)
 
 	req := GetRequest()
@@ -248,7 +260,7 @@ func (c *Client) queryCode(
 			if err != nil {
 				return code, err
 			}
-			req.Header.Set("content-encoding", "gzip")
+			req.Header.Set("content-encoding", encodingGzip)
 			req.SetBody(buf)
 		} else {
 			req.SetBody(b)
@@ -975,10 +987,24 @@ func (c *Client) Track(track *ReqTrack) (int, error) {
 		return defaultStatus, nil
 	}
 
-	traceID, req := c.getRequest(&track.ReqHeader, true)
+	traceID := track.TraceID
+	if traceID == "" {
+		traceID = uuid.New().String()
+	}
+	traceID, req := c.getRequestWithTraceID(traceID, &track.ReqHeader, true)
+	// 埋点数据可能属于不同的 CPID, 产品或渠道, track.Header 中的路由请求头需覆盖 Config 中的默认值
+	for k, v := range track.Header {
+		req.Header.Del(k)
+		req.Header.Set(k, v)
+	}
 	ret := &response{}
 	req.Header.Add(headerDataCount, Itoa(track.LogCount))
-	code, err := c.queryCode(apiBigDataTrack, &track.ReqHeader, req, config.TrackTimeout, track.Data, ret, track.Compress)
+	compress := track.Compress
+	if track.Encoding != "" {
+		req.Header.Set("content-encoding", track.Encoding)
+		compress = false
+	}
+	code, err := c.queryCode(apiBigDataTrack, &track.ReqHeader, req, config.TrackTimeout, track.Data, ret, compress)
 	if err != nil {
 		return code, errWithTraceID(err, traceID)
 	}
@@ -992,117 +1018,155 @@ func (c *Client) Track(track *ReqTrack) (int, error) {
 // SyncTrack 同步接口 直接将埋点数据上报给瑞雪云
 // 前提要设置好 config
 func (c *Client) SyncTrack(devicecode, distinctID string, opts ...BigdataOptions) error {
-	if devicecode == "" && distinctID == "" {
-		return ErrInvalidDevicecode
-	}
-
-	logData := &BigDataLog{
+	return c.SyncTrackV2(&ReqSyncTrack{
+		DeviceCode: devicecode,
 		DistinctID: distinctID,
-		Devicecode: devicecode,
-	}
-	for _, opt := range opts {
-		err := opt(logData)
-		if err != nil {
-			return err
-		}
-	}
-	if logData.Type == "" {
-		return ErrInvalidType
-	}
-	if logData.CPID == 0 {
-		if config.CPID == 0 {
-			return ErrInvalidCPID
-		}
-		logData.CPID = config.CPID
-	}
-	if logData.PlatformID <= 0 {
-		logData.PlatformID = 10
-	}
-	if logData.UUID == "" {
-		logData.UUID = uuid.New().String()
-	}
-	if logData.Time == "" {
-		logData.Time = time.Now().Format(time.RFC3339Nano)
-	}
-
-	data := []*BigDataLog{logData}
-
-	b, err := MarshalJSON(data)
-	if err != nil {
-		return err
-	}
-
-	traceID, req := c.getRequest(&ReqHeader{}, true)
-	ret := &response{}
-	req.Header.Add(headerDataCount, Itoa(1))
-	_, err = c.queryCode(apiBigDataTrack, &ReqHeader{}, req, config.TrackTimeout, b, ret, !config.BigData.DisableCompress)
-	if err != nil {
-		return errWithTraceID(err, traceID)
-	}
-	err = c.checkResponse(ret)
-	if err != nil {
-		return errWithTraceID(err, traceID)
-	}
-	return nil
+		Opts:       opts,
+	})
 }
 
 // SyncTrackV2 同步接口 直接将埋点数据上报给瑞雪云
 // 前提要设置好 config
 func (c *Client) SyncTrackV2(track *ReqSyncTrack) error {
-	if track.DeviceCode == "" && track.DistinctID == "" {
-		return ErrInvalidDevicecode
+	errs := c.SyncTrackBatch(&ReqSyncTrackBatch{
+		ReqHeader: track.ReqHeader,
+		Tracks:    []*ReqSyncTrack{track},
+	})
+	return errs[0]
+}
+
+// SyncTrackBatch 同步接口 批量将埋点数据直接上报给瑞雪云, 按路由 (CPID, 产品, 渠道, 区域, 区服) 与 BigDataConfig.BatchSize 分批上报
+// 返回与 req.Tracks 一一对应的结果, 为 nil 表示上报成功, 事件被过滤或在去重窗口内重复
+// 每条事件的 ReqHeader 不生效, 统一使用 req.ReqHeader
+// 调试模式下不上报, 事件交给 DryRunHandler 处理; 上报成功的事件同时写入 Sinks 与 DurableWriter, 并计入 Producer 的运行统计
+func (c *Client) SyncTrackBatch(req *ReqSyncTrackBatch) []error {
+	errs := make([]error, len(req.Tracks))
+	p := c.producer
+	if p == nil || p.isShutDown.Load() {
+		err := errBigDataNotConfigured
+		if p != nil {
+			err = errProducerShutdown
+		}
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
 	}
+	p.wg.Add(1)
+	defer p.wg.Done()
 
-	logData := &BigDataLog{
-		DistinctID: track.DistinctID,
-		Devicecode: track.DeviceCode,
-	}
-	for _, opt := range track.Opts {
-		err := opt(logData)
+	logs := make([]*BigDataLog, 0, len(req.Tracks))
+	indexes := make([]int, 0, len(req.Tracks))
+	for i, track := range req.Tracks {
+		if track == nil {
+			errs[i] = fmt.Errorf("%w: track is nil", ErrInvalidParam)
+			continue
+		}
+		logData, err := p.buildLog(track.DeviceCode, track.DistinctID, track.Opts...)
 		if err != nil {
-			return err
+			p.stats.addRejected(err)
+			errs[i] = err
+			continue
 		}
-	}
-	if logData.Type == "" {
-		return ErrInvalidType
-	}
-	if logData.CPID == 0 {
-		if config.CPID == 0 {
-			return ErrInvalidCPID
+		if logData == nil {
+			atomic.AddInt64(&p.stats.filtered, 1)
+			continue
 		}
-		logData.CPID = config.CPID
-	}
-	if logData.PlatformID <= 0 {
-		logData.PlatformID = 10
-	}
-	if logData.UUID == "" {
-		logData.UUID = uuid.New().String()
+		if p.isDuplicate(logData) {
+			logData.release()
+			continue
+		}
+		logs = append(logs, logData)
+		indexes = append(indexes, i)
 	}
-	if logData.Time == "" {
-		logData.Time = time.Now().Format(time.RFC3339Nano)
+	if len(logs) == 0 {
+		return errs
 	}
+	atomic.AddInt64(&p.stats.accepted, int64(len(logs)))
 
-	data := []*BigDataLog{logData}
-
-	b, err := MarshalJSON(data)
-	if err != nil {
-		return err
+	if p.conf.DryRun {
+		err := p.write(logs...)
+		for _, i := range indexes {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	type chunk struct {
+		route   routeKey
+		logs    []*BigDataLog
+		indexes []int
+	}
+	var chunks []*chunk
+	pending := make(map[routeKey]*chunk)
+	batchSize := p.conf.BatchSize
+	for i, logData := range logs {
+		route := logData.route()
+		ck := pending[route]
+		if ck == nil || len(ck.logs) == batchSize {
+			ck = &chunk{route: route}
+			chunks = append(chunks, ck)
+			pending[route] = ck
+		}
+		ck.logs = append(ck.logs, logData)
+		ck.indexes = append(ck.indexes, indexes[i])
+	}
+
+	concurrency := req.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	wg := sync.WaitGroup{}
+	for _, ck := range chunks {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(ck *chunk) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			header := ReqHeader{}
+			for k, v := range req.Header {
+				header.Set(k, v)
+			}
+			ck.route.setHeader(&header)
+			size, compressed, err := c.syncTrackLogs(&header, ck.logs)
+			if err != nil {
+				// 上报失败时调用方会重试, 不能按重复事件丢弃, 也不写入其他输出目标
+				p.stats.trackFailed(size, compressed, err)
+				p.forgetDuplicates(ck.logs)
+			} else {
+				p.stats.uploadSucceeded(len(ck.logs), size, compressed)
+				p.fanOut(ck.logs)
+			}
+			for _, i := range ck.indexes {
+				errs[i] = err
+			}
+		}(ck)
 	}
+	wg.Wait()
+	releaseLogs(logs)
+	return errs
+}
 
-	traceID, req := c.getRequest(&track.ReqHeader, true)
-	ret := &response{}
-	req.Header.Add(headerDataCount, Itoa(1))
-	_, err = c.queryCode(apiBigDataTrack, &track.ReqHeader, req, config.TrackTimeout,
-		b, ret, !config.BigData.DisableCompress)
+// syncTrackLogs 编码并上报一批数据, 返回压缩前后的字节数
+func (c *Client) syncTrackLogs(header *ReqHeader, logs []*BigDataLog) (size, compressed int, err error) {
+	buf := bufferpool.Get()
+	defer bufferpool.Put(buf)
 
+	codec := c.producer.conf.codec
+	size, err = encodeBatch(buf, codec, logs)
 	if err != nil {
-		return errWithTraceID(err, traceID)
-	}
-	err = c.checkResponse(ret)
-	if err != nil {
-		return errWithTraceID(err, traceID)
-	}
-	return nil
+		return size, buf.Len(), err
+	}
+	_, err = c.Track(&ReqTrack{
+		ReqHeader: *header,
+		Data:      buf.Bytes(),
+		LogCount:  len(logs),
+		Encoding:  codec.Encoding(),
+	})
+	return size, buf.Len(), err
 }
 
 // CreateRank 创建排行榜
@@ -0,0 +1,108 @@
+// Copyright (c) 2022. Homeland Interactive Technology Ltd. All rights reserved.
+
+package ruixuego
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestClient 创建上报到 httptest 服务的 Client, fail 为 true 时服务返回错误
+func newTestClient(t *testing.T, conf *BigDataConfig, fail *int32) *Client {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(fail) != 0 {
+			w.Write([]byte(`{"code":500,"msg":"fail"}`))
+			return
+		}
+		w.Write([]byte(`{"code":0}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	setTestConfig(t, &Config{APIDomain: srv.URL, CPID: 1, Timeout: time.Second, TrackTimeout: time.Second, Concurrency: 10})
+
+	c := &Client{httpClient: NewHTTPClient(config.Timeout, config.Concurrency)}
+	p, err := NewProducer(c, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.producer = p
+	return c
+}
+
+func TestSyncTrackBatchStatsAndSinks(t *testing.T) {
+	var (
+		mutex sync.Mutex
+		sunk  []string
+		fail  int32
+	)
+	sink := SinkFunc(func(logs []*BigDataLog) error {
+		mutex.Lock()
+		for _, logData := range logs {
+			sunk = append(sunk, logData.Event)
+		}
+		mutex.Unlock()
+		return nil
+	})
+	c := newTestClient(t, &BigDataConfig{Sinks: []*SinkConfig{{Name: "s", Sink: sink}}}, &fail)
+
+	errs := c.SyncTrackBatch(&ReqSyncTrackBatch{Tracks: []*ReqSyncTrack{
+		{DeviceCode: "d", Opts: []BigdataOptions{SetEvent("ok")}},
+		{Opts: []BigdataOptions{SetEvent("rejected")}},
+	}})
+	if errs[0] != nil || !errors.Is(errs[1], ErrInvalidDevicecode) {
+		t.Fatalf("got errors %v", errs)
+	}
+	atomic.StoreInt32(&fail, 1)
+	if err := c.SyncTrack("d", "", SetEvent("failed")); err == nil {
+		t.Fatal("want error")
+	}
+
+	stats := c.producer.Stats()
+	if stats.Accepted != 2 || stats.RejectedDevicecode != 1 || stats.Uploaded != 1 || stats.Retried != 0 {
+		t.Errorf("got stats %+v", stats)
+	}
+	if stats.BytesSent == 0 || stats.LastError == "" || stats.LastUploadTime.IsZero() {
+		t.Errorf("got stats %+v", stats)
+	}
+
+	if err := c.producer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// 只有上报成功的事件写入其他输出目标
+	if len(sunk) != 1 || sunk[0] != "ok" {
+		t.Errorf("got sink events %v", sunk)
+	}
+	if err := c.SyncTrack("d", "", SetEvent("closed")); !errors.Is(err, errProducerShutdown) {
+		t.Errorf("got %v after Close, want errProducerShutdown", err)
+	}
+}
+
+func TestSyncTrackBatchDryRun(t *testing.T) {
+	var (
+		fail int32
+		got  []string
+	)
+	c := newTestClient(t, &BigDataConfig{DryRun: true, DryRunHandler: func(logs []*BigDataLog) {
+		for _, logData := range logs {
+			got = append(got, logData.Event)
+		}
+	}}, &fail)
+	// 调试模式下不会请求上报接口
+	atomic.StoreInt32(&fail, 1)
+
+	if err := c.SyncTrack("d", "", SetEvent("e")); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0] != "e" {
+		t.Errorf("got dry run events %v", got)
+	}
+	if stats := c.producer.Stats(); stats.Accepted != 1 || stats.Uploaded != 0 {
+		t.Errorf("got stats %+v", stats)
+	}
+}
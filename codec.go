@@ -0,0 +1,223 @@
+// Copyright (c) 2022. Homeland Interactive Technology Ltd. All rights reserved.
+
+package ruixuego
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// 埋点上报支持的压缩算法
+const (
+	CompressionGzip   = "gzip"
+	CompressionZstd   = "zstd"
+	CompressionBrotli = "br"
+	CompressionNone   = "none"
+)
+
+const (
+	encodingZstd   = CompressionZstd
+	encodingBrotli = CompressionBrotli
+)
+
+// Codec 埋点上报数据的压缩编码
+type Codec interface {
+	// Encoding 返回请求头 content-encoding 的值, 为空表示不压缩
+	Encoding() string
+
+	// NewWriter 返回一个将压缩数据写入 w 的流, Close 后所有数据才会完整写入 w
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+
+	// NewReader 返回一个解压 r 的流
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// NewCodec 按压缩算法名与压缩级别创建 Codec, level 为 0 时使用该算法的默认级别
+//
+//	gzip 级别范围 1 ~ 9, 默认 gzip.BestCompression
+//	zstd 级别范围 1 ~ 22, 默认 3
+//	br   级别范围 0 ~ 11, 默认 6
+func NewCodec(compression string, level int) (Codec, error) {
+	switch strings.ToLower(compression) {
+	case "", CompressionGzip:
+		if level == 0 {
+			level = gzip.BestCompression
+		}
+		if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+			return nil, fmt.Errorf("%w: gzip compression level %d", ErrInvalidParam, level)
+		}
+		return &gzipCodec{level: level}, nil
+	case CompressionZstd:
+		if level == 0 {
+			level = 3
+		}
+		if level < 1 || level > 22 {
+			return nil, fmt.Errorf("%w: zstd compression level %d", ErrInvalidParam, level)
+		}
+		return &zstdCodec{level: zstd.EncoderLevelFromZstd(level)}, nil
+	case CompressionBrotli:
+		if level == 0 {
+			level = brotli.DefaultCompression
+		}
+		if level < brotli.BestSpeed || level > brotli.BestCompression {
+			return nil, fmt.Errorf("%w: brotli compression level %d", ErrInvalidParam, level)
+		}
+		return &brotliCodec{level: level}, nil
+	case CompressionNone:
+		return noneCodec{}, nil
+	}
+	return nil, fmt.Errorf("%w: unsupported compression %q", ErrInvalidParam, compression)
+}
+
+// codecForEncoding 按 content-encoding 返回解压使用的 Codec
+func codecForEncoding(encoding string) (Codec, error) {
+	switch encoding {
+	case "":
+		return noneCodec{}, nil
+	case encodingGzip, encodingZstd, encodingBrotli:
+		return NewCodec(encoding, 0)
+	}
+	return nil, fmt.Errorf("%w: unsupported content-encoding %q", ErrInvalidParam, encoding)
+}
+
+type noneCodec struct{}
+
+func (noneCodec) Encoding() string {
+	return ""
+}
+
+func (noneCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+func (noneCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(r), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// 各压缩算法的 Codec 将压缩流连同包装对象一起放回对象池, 复用时不再分配内存
+
+type gzipCodec struct {
+	level   int
+	writers sync.Pool
+}
+
+func (c *gzipCodec) Encoding() string {
+	return encodingGzip
+}
+
+func (c *gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	if pw, ok := c.writers.Get().(*gzipPooledWriter); ok {
+		pw.Reset(w)
+		return pw, nil
+	}
+	gw, err := gzip.NewWriterLevel(w, c.level)
+	if err != nil {
+		return nil, err
+	}
+	return &gzipPooledWriter{Writer: gw, codec: c}, nil
+}
+
+func (c *gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// gzipPooledWriter Close 后放回对象池
+type gzipPooledWriter struct {
+	*gzip.Writer
+	codec *gzipCodec
+}
+
+func (w *gzipPooledWriter) Close() error {
+	err := w.Writer.Close()
+	w.codec.writers.Put(w)
+	return err
+}
+
+type zstdCodec struct {
+	level   zstd.EncoderLevel
+	writers sync.Pool
+}
+
+func (c *zstdCodec) Encoding() string {
+	return encodingZstd
+}
+
+func (c *zstdCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	if pw, ok := c.writers.Get().(*zstdPooledWriter); ok {
+		pw.Reset(w)
+		return pw, nil
+	}
+	e, err := zstd.NewWriter(w, zstd.WithEncoderLevel(c.level), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return &zstdPooledWriter{Encoder: e, codec: c}, nil
+}
+
+func (c *zstdCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return d.IOReadCloser(), nil
+}
+
+// zstdPooledWriter Close 后放回对象池
+type zstdPooledWriter struct {
+	*zstd.Encoder
+	codec *zstdCodec
+}
+
+func (w *zstdPooledWriter) Close() error {
+	err := w.Encoder.Close()
+	w.codec.writers.Put(w)
+	return err
+}
+
+type brotliCodec struct {
+	level   int
+	writers sync.Pool
+}
+
+func (c *brotliCodec) Encoding() string {
+	return encodingBrotli
+}
+
+func (c *brotliCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	if pw, ok := c.writers.Get().(*brotliPooledWriter); ok {
+		pw.Reset(w)
+		return pw, nil
+	}
+	return &brotliPooledWriter{Writer: brotli.NewWriterLevel(w, c.level), codec: c}, nil
+}
+
+func (c *brotliCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(brotli.NewReader(r)), nil
+}
+
+// brotliPooledWriter Close 后放回对象池
+type brotliPooledWriter struct {
+	*brotli.Writer
+	codec *brotliCodec
+}
+
+func (w *brotliPooledWriter) Close() error {
+	err := w.Writer.Close()
+	w.codec.writers.Put(w)
+	return err
+}
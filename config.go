@@ -14,6 +14,10 @@ const (
 	bigDataDefaultCacheCapacity     = 2000             // 默认缓存容量
 	bigDataDefaultBatchSize         = 20               // 默认批量发送条数
 	bigDataDefaultAutoFlushInterval = 30 * time.Second // 默认自动上传间隔 30 秒
+	bigDataDefaultRetryInterval     = time.Second      // 默认上报失败后首次重试间隔 1 秒
+	bigDataDefaultRetryMaxInterval  = 2 * time.Minute  // 默认上报失败后最大重试间隔 2 分钟
+	bigDataDefaultUploadWorkers     = 1                // 默认并发上报数
+	bigDataDefaultDedupCapacity     = 100000           // 默认去重窗口内最多记录的 UUID 数
 )
 
 // Config 瑞雪配置
@@ -61,11 +65,40 @@ func (conf *Config) done() {
 }
 
 type BigDataConfig struct {
-	CacheCapacity     int           `json:"cache_capacity"`      // 缓存容量
-	BatchSize         int           `json:"batch_size"`          // 大数据埋点批量发送每批条数
-	AutoFlushInterval time.Duration `json:"auto_flush_interval"` // 自动上传间隔, 单位秒
-	AutoFlush         bool          `json:"auto_flush"`          // 是否启动自动上传
-	DisableCompress   bool          `json:"disable_compress"`    // 是否禁用 GZip 压缩
+	CacheCapacity     int              `json:"cache_capacity"`       // 缓存容量
+	HighCacheCapacity int              `json:"high_cache_capacity"`  // 高优先级事件的缓存容量, 与 CacheCapacity 分别计算, 默认同 CacheCapacity
+	BatchSize         int              `json:"batch_size"`           // 大数据埋点批量发送每批条数
+	AutoFlushInterval time.Duration    `json:"auto_flush_interval"`  // 自动上传间隔, 单位秒
+	AutoFlush         bool             `json:"auto_flush"`           // 是否启动自动上传
+	RetryInterval     time.Duration    `json:"retry_interval"`       // 上报失败后首次重试间隔, 之后按指数退避
+	RetryMaxInterval  time.Duration    `json:"retry_max_interval"`   // 上报失败后最大重试间隔
+	UploadWorkers     int              `json:"upload_workers"`       // 并发上报的批次数, 默认 1; 大于 1 时异步上报, Tracks 不返回上报错误
+	OrderByDistinctID bool             `json:"order_by_distinct_id"` // 并发上报时是否保证同一 DistinctID 的数据按写入顺序上报
+	DisableCompress   bool             `json:"disable_compress"`     // 是否禁用 GZip 压缩
+	Compression       string           `json:"compression"`          // 压缩算法: gzip, zstd, br, none, 默认 gzip
+	CompressionLevel  int              `json:"compression_level"`    // 压缩级别, 为 0 时使用压缩算法的默认级别
+	Codec             Codec            `json:"-"`                    // 自定义压缩编码, 优先于 Compression
+	DedupWindow       time.Duration    `json:"dedup_window"`         // 按 UUID 去重的时间窗口, 窗口内重复的事件不再上报, 因缓存已满被丢弃的事件可以重新提交, 为 0 时不去重
+	DedupCapacity     int              `json:"dedup_capacity"`       // 去重窗口内最多记录的 UUID 数, 超出后淘汰最早的记录, 默认 100000
+	IdentityCacheSize int              `json:"identity_cache_size"`  // 设备码与用户标识关联缓存的容量, 大于 0 时只传设备码的事件自动填充已关联的用户标识
+	IdentityCacheTTL  time.Duration    `json:"identity_cache_ttl"`   // 设备码与用户标识关联的有效期, 为 0 时不过期
+	TimeFormat        string           `json:"time_format"`          // 事件时间格式, 默认 "2006-01-02 15:04:05.000"
+	TimeZone          string           `json:"time_zone"`            // 事件时间时区, 如 Asia/Shanghai, UTC, 为空时使用服务器本地时区
+	Normalize         *NormalizeConfig `json:"normalize"`            // 自定义属性规范化配置, 为空时不做规范化
+	Redact            *RedactConfig    `json:"redact"`               // 敏感属性处理配置, 为空时不处理
+	Schema            *SchemaRegistry  `json:"-"`                    // 事件定义注册表, 为空时不校验
+	AllowEvents       []string         `json:"allow_events"`         // 事件白名单, 支持 path.Match 通配符, 为空时不限制
+	DenyEvents        []string         `json:"deny_events"`          // 事件黑名单, 支持 path.Match 通配符
+	SampleRules       []*SampleRule    `json:"sample_rules"`         // 事件采样规则, 按顺序使用第一条匹配的规则
+	EventHook         EventHook        `json:"-"`                    // 事件钩子, 可修改或丢弃事件
+	Writer            LogWriter        `json:"-"`                    // 自定义写入实现, 为空时批量上传瑞雪云
+	DurableWriter     LogWriter        `json:"-"`                    // 高优先级事件额外写入的持久化写入器, 如 FileWriter, 为空或调试模式时不写入
+	Sinks             []*SinkConfig    `json:"sinks"`                // 其他输出目标, 与上报瑞雪云 (或 Writer) 使用同一份数据, 各自独立发送, 调试模式时不写入
+	DryRun            bool             `json:"dry_run"`              // 调试模式, 事件完成构建与校验后不上报也不写入 Sinks 与 DurableWriter, 交给 DryRunHandler 处理或输出到日志
+	DryRunHandler     DryRunHandler    `json:"-"`                    // 调试模式下的事件处理函数, 为空时输出到日志
+	Verbose           bool             `json:"verbose"`              // 是否输出每批上报的摘要日志
+	codec             Codec
+	location          *time.Location
 	_done             bool
 }
 
@@ -79,11 +112,80 @@ func (conf *BigDataConfig) done() {
 	if conf.CacheCapacity == 0 {
 		conf.CacheCapacity = bigDataDefaultCacheCapacity
 	}
+	if conf.HighCacheCapacity <= 0 {
+		conf.HighCacheCapacity = conf.CacheCapacity
+	}
 	if conf.BatchSize == 0 {
 		conf.BatchSize = bigDataDefaultBatchSize
 	}
 	if conf.AutoFlushInterval == 0 {
 		conf.AutoFlushInterval = bigDataDefaultAutoFlushInterval
 	}
+	if conf.UploadWorkers <= 0 {
+		conf.UploadWorkers = bigDataDefaultUploadWorkers
+	}
+	if conf.RetryInterval == 0 {
+		conf.RetryInterval = bigDataDefaultRetryInterval
+	}
+	if conf.RetryMaxInterval == 0 {
+		conf.RetryMaxInterval = bigDataDefaultRetryMaxInterval
+	}
+	if conf.RetryMaxInterval < conf.RetryInterval {
+		conf.RetryMaxInterval = conf.RetryInterval
+	}
+	if conf.DedupWindow > 0 && conf.DedupCapacity <= 0 {
+		conf.DedupCapacity = bigDataDefaultDedupCapacity
+	}
+	if conf.TimeFormat == "" {
+		conf.TimeFormat = dateTimeFormat
+	}
 	conf._done = true
 }
+
+// check 检查配置并初始化依赖配置生成的对象
+func (conf *BigDataConfig) check() error {
+	err := conf.checkFilter()
+	if err != nil {
+		return err
+	}
+
+	if conf.Normalize != nil {
+		err = conf.Normalize.check()
+		if err != nil {
+			return err
+		}
+	}
+
+	if conf.Redact != nil {
+		err = conf.Redact.check()
+		if err != nil {
+			return err
+		}
+		if conf.Normalize != nil && conf.Normalize.Flatten {
+			conf.Redact.separator = conf.Normalize.Separator
+		}
+	}
+
+	err = conf.checkSinks()
+	if err != nil {
+		return err
+	}
+
+	conf.location, err = loadLocation(conf.TimeZone)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case conf.Codec != nil:
+		conf.codec = conf.Codec
+	case conf.DisableCompress:
+		conf.codec = noneCodec{}
+	default:
+		conf.codec, err = NewCodec(conf.Compression, conf.CompressionLevel)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -15,8 +15,13 @@ var (
 	ErrInvalidIMSConversationID = errors.New("invalid ims conversation id")
 	ErrInvalidParam             = errors.New("invalid param")
 	ErrInvalidCPuserID          = errors.New("invalid cp_user_id")
+	ErrInvalidProperty          = errors.New("invalid property")
+	ErrUnknownEvent             = errors.New("unknown event")
+	ErrInvalidUserOperation     = errors.New("invalid user operation")
+	ErrInvalidTime              = errors.New("invalid time")
 
-	errProducerShutdown = errors.New("producer already shut down")
+	errProducerShutdown     = errors.New("producer already shut down")
+	errBigDataNotConfigured = errors.New("bigdata not configured")
 )
 
 type Error struct {
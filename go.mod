@@ -3,14 +3,14 @@ module github.com/ruixueyun/ruixuego
 go 1.17
 
 require (
+	github.com/andybalholm/brotli v1.0.2
 	github.com/google/uuid v1.3.0
 	github.com/json-iterator/go v1.1.12
+	github.com/klauspost/compress v1.13.6
 	github.com/valyala/fasthttp v1.31.0
 )
 
 require (
-	github.com/andybalholm/brotli v1.0.2 // indirect
-	github.com/klauspost/compress v1.13.6 // indirect
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
 	github.com/modern-go/reflect2 v1.0.2 // indirect
 	github.com/stretchr/testify v1.8.2 // indirect
@@ -0,0 +1,125 @@
+// Copyright (c) 2022. Homeland Interactive Technology Ltd. All rights reserved.
+
+package ruixuego
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// lruCache 并发安全的 LRU 缓存, 超出容量时淘汰最久未使用的数据, ttl 大于 0 时数据写入 ttl 后过期
+type lruCache struct {
+	capacity int
+	ttl      time.Duration
+	mutex    sync.Mutex
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+type lruEntry struct {
+	key      string
+	value    interface{}
+	expireAt time.Time
+}
+
+func newLRUCache(capacity int, ttl time.Duration) *lruCache {
+	return &lruCache{
+		capacity: capacity,
+		ttl:      ttl,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// Get 获取未过期的数据
+func (c *lruCache) Get(key string) (interface{}, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*lruEntry)
+	if c.expired(entry, time.Now()) {
+		c.remove(e)
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	return entry.value, true
+}
+
+// Set 写入数据并重置过期时间
+func (c *lruCache) Set(key string, value interface{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.set(key, value, time.Now())
+}
+
+// SetIfAbsent 数据不存在或已过期时写入并返回 true, 否则返回 false
+func (c *lruCache) SetIfAbsent(key string, value interface{}) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	if e, ok := c.items[key]; ok && !c.expired(e.Value.(*lruEntry), now) {
+		c.ll.MoveToFront(e)
+		return false
+	}
+	c.set(key, value, now)
+	return true
+}
+
+// Delete 删除数据
+func (c *lruCache) Delete(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		c.remove(e)
+	}
+}
+
+// Len 返回缓存中的数据条数, 包含已过期但尚未清理的数据
+func (c *lruCache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.ll.Len()
+}
+
+func (c *lruCache) set(key string, value interface{}, now time.Time) {
+	var expireAt time.Time
+	if c.ttl > 0 {
+		expireAt = now.Add(c.ttl)
+	}
+	if e, ok := c.items[key]; ok {
+		entry := e.Value.(*lruEntry)
+		entry.value, entry.expireAt = value, expireAt
+		c.ll.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.ll.PushFront(&lruEntry{key: key, value: value, expireAt: expireAt})
+	c.evict(now)
+}
+
+// evict 清理队尾已过期的数据, 并淘汰超出容量的数据
+func (c *lruCache) evict(now time.Time) {
+	for c.ll.Len() > 0 {
+		e := c.ll.Back()
+		if c.ll.Len() <= c.capacity && !c.expired(e.Value.(*lruEntry), now) {
+			return
+		}
+		c.remove(e)
+	}
+}
+
+func (c *lruCache) expired(entry *lruEntry, now time.Time) bool {
+	return c.ttl > 0 && now.After(entry.expireAt)
+}
+
+func (c *lruCache) remove(e *list.Element) {
+	c.ll.Remove(e)
+	delete(c.items, e.Value.(*lruEntry).key)
+}
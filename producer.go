@@ -3,67 +3,156 @@
 package ruixuego
 
 import (
+	"fmt"
 	"sync"
-	"time"
+	"sync/atomic"
 
 	"github.com/google/uuid"
 )
 
 type BigdataOptions func(p *BigDataLog) error
 
+// userOperations 支持的用户属性操作, map[操作]属性值是否必须为数值
+var userOperations = map[string]bool{
+	UserSet:     false,
+	UserSetOnce: false,
+	UserAdd:     true,
+	UserMin:     true,
+	UserMax:     true,
+}
+
 func NewProducer(t TrackInterface, conf *BigDataConfig) (*Producer, error) {
 	conf.done()
-
-	w := newBatchWriter(t, conf)
-	err := w.Init()
+	err := conf.check()
 	if err != nil {
 		return nil, err
 	}
 
-	return &Producer{
-		writer:     w,
+	p := &Producer{
+		conf:       conf,
+		stats:      &producerStats{},
 		isShutDown: &Bool{},
-	}, nil
+	}
+	if conf.DedupWindow > 0 {
+		p.dedup = newLRUCache(conf.DedupCapacity, conf.DedupWindow)
+	}
+	if conf.IdentityCacheSize > 0 {
+		p.identities = newLRUCache(conf.IdentityCacheSize, conf.IdentityCacheTTL)
+	}
+
+	var w LogWriter
+	switch {
+	case conf.DryRun:
+		w = newDryRunWriter(conf)
+	case conf.Writer != nil:
+		w = conf.Writer
+	default:
+		bw := newBatchWriter(t, conf, p.stats)
+		// 未上报就被丢弃的事件不再占用去重记录, 调用方可以重新提交
+		bw.dropped = p.forgetDuplicates
+		w = bw
+	}
+	err = w.Init()
+	if err != nil {
+		return nil, err
+	}
+	if conf.DurableWriter != nil {
+		err = conf.DurableWriter.Init()
+		if err != nil {
+			w.Close()
+			return nil, fmt.Errorf("bigdata durable writer init failed: %w", err)
+		}
+	}
+	sinks := make([]*sinkQueue, 0, len(conf.Sinks))
+	for _, sc := range conf.Sinks {
+		q := newSinkQueue(sc)
+		err = q.init()
+		if err != nil {
+			for _, q := range sinks {
+				q.close()
+			}
+			w.Close()
+			if conf.DurableWriter != nil {
+				conf.DurableWriter.Close()
+			}
+			return nil, fmt.Errorf("bigdata sink %s init failed: %w", sc.Name, err)
+		}
+		sinks = append(sinks, q)
+	}
+	p.writer = w
+	p.sinks = sinks
+	return p, nil
 }
 
-type logWriter interface {
+// LogWriter 埋点数据写入接口, 默认使用批量上传瑞雪云的实现
+// 可通过 BigDataConfig.Writer 替换为其他实现, 如 FileWriter
+type LogWriter interface {
+	// Init 初始化, 在 NewProducer 中调用
 	Init() error
-	Write(*BigDataLog) error
+
+	// Write 写入埋点数据, 同一次调用的数据应作为整体写入
+	// 自定义实现可以持有 logs, SDK 不再修改或复用这些数据
+	Write(logs ...*BigDataLog) error
+
+	// Flush 将缓冲中的数据立即写出
 	Flush() error
+
+	// Close 写出所有数据并释放资源, 在 Producer.Close 中调用
 	Close() error
 }
 
 type Producer struct {
-	writer     logWriter
+	conf       *BigDataConfig
+	writer     LogWriter
+	sinks      []*sinkQueue
+	stats      *producerStats
 	wg         sync.WaitGroup
 	isShutDown *Bool
+
+	superMutex      sync.RWMutex
+	superProperties map[string]interface{}
+	superProvider   SuperPropertiesProvider
+
+	dedup      *lruCache // 去重窗口内已接收的 UUID
+	identities *lruCache // 设备码关联的用户标识
+
+	closeMutex sync.Mutex
+	closers    []func() error // Close 时先于写入器关闭调用, 如 SessionTracker
 }
 
 // SetPreset 预制属性
+// PresetKeyTime 支持 time.Time, Unix 时间戳 (秒或毫秒), 以及 BigDataConfig.TimeFormat 或 RFC3339 格式的字符串,
+// 上报时统一转换为 BigDataConfig 配置的时间格式与时区, 无法解析时 Tracks 返回 ErrInvalidTime
 func SetPreset(preset map[string]interface{}) BigdataOptions {
 	return func(logData *BigDataLog) error {
-		cpID := extractCPID(preset)
-		if cpID == 0 {
-			return ErrInvalidCPID
-		}
-		logData.CPID = cpID
-		logData.UUID = extractUUID(preset)
-		logData.Time = extractTime(preset)
-		if preset != nil {
-			logData.PlatformID = extractInt32(preset, PresetKeyPlatformID)
-			logData.ProductID = extractStringProperty(preset, PresetKeyProductID)
-			logData.ChannelID = extractStringProperty(preset, PresetKeyChannelID)
-			logData.SubChannelID = extractStringProperty(preset, PresetKeySubChannelID)
-			logData.IP = extractStringProperty(preset, PresetKeyIP)
-		}
-		return nil
+		return applyPreset(logData, preset)
 	}
 }
 
+func applyPreset(logData *BigDataLog, preset map[string]interface{}) error {
+	cpID := extractCPID(preset)
+	if cpID == 0 {
+		return ErrInvalidCPID
+	}
+	logData.CPID = cpID
+	logData.UUID = extractUUID(preset)
+	logData.rawTime = preset[PresetKeyTime]
+	if preset != nil {
+		logData.PlatformID = extractInt32(preset, PresetKeyPlatformID)
+		logData.ProductID = extractStringProperty(preset, PresetKeyProductID)
+		logData.ChannelID = extractStringProperty(preset, PresetKeyChannelID)
+		logData.SubChannelID = extractStringProperty(preset, PresetKeySubChannelID)
+		logData.IP = extractStringProperty(preset, PresetKeyIP)
+		logData.region = extractStringProperty(preset, PresetKeyRegion)
+		logData.serviceMark = extractStringProperty(preset, PresetKeyServiceMark)
+	}
+	return nil
+}
+
 // SetProperties 自定义属性
 func SetProperties(properties map[string]interface{}) BigdataOptions {
 	return func(p *BigDataLog) error {
-		p.Properties = properties
+		p.setProperties(properties, false)
 		return nil
 	}
 }
@@ -71,79 +160,240 @@ func SetProperties(properties map[string]interface{}) BigdataOptions {
 // SetEvent 事件名
 func SetEvent(event string) BigdataOptions {
 	return func(logData *BigDataLog) error {
-		if event == "" {
-			return ErrInvalidEvent
-		}
-		logData.Type = typeTrack
-		logData.Event = event
-		return nil
+		return setEvent(logData, typeTrack, event)
 	}
 }
 
 // SetUpdateEvent 可更新事件名
 func SetUpdateEvent(event string) BigdataOptions {
 	return func(logData *BigDataLog) error {
-		if event == "" {
-			return ErrInvalidEvent
-		}
-		logData.Type = typeUpdateTrack
-		logData.Event = event
-		return nil
+		return setEvent(logData, typeUpdateTrack, event)
 	}
 }
 
 // SetFirstEvent 首次事件名
 func SetFirstEvent(event string) BigdataOptions {
 	return func(logData *BigDataLog) error {
-		if event == "" {
-			return ErrInvalidEvent
-		}
-		logData.Type = typeFirstTrack
-		logData.Event = event
-		return nil
+		return setEvent(logData, typeFirstTrack, event)
 	}
 }
 
-// SetUserUpdateType 用户更新类型：user_setonce,user_set
+// SetUserUpdateType 用户更新类型：user_setonce,user_set,user_add,user_min,user_max
 func SetUserUpdateType(updateType string) BigdataOptions {
 	return func(p *BigDataLog) error {
-		p.Type = typeUser
-		p.Event = updateType
+		return setEvent(p, typeUser, updateType)
+	}
+}
+
+func setEvent(logData *BigDataLog, typ, event string) error {
+	if typ == typeUser {
+		if _, ok := userOperations[event]; !ok {
+			return ErrInvalidUserOperation
+		}
+	} else if event == "" {
+		return ErrInvalidEvent
+	}
+	logData.Type = typ
+	logData.Event = event
+	return nil
+}
+
+// SetUserSet 设置用户属性, 覆盖已有值
+func SetUserSet(properties map[string]interface{}) BigdataOptions {
+	return setUserOperation(UserSet, properties)
+}
+
+// SetUserSetOnce 设置用户属性, 属性已有值时不覆盖
+func SetUserSetOnce(properties map[string]interface{}) BigdataOptions {
+	return setUserOperation(UserSetOnce, properties)
+}
+
+// SetUserAdd 对数值类型的用户属性做累加, 属性值必须为数值
+func SetUserAdd(properties map[string]interface{}) BigdataOptions {
+	return setUserOperation(UserAdd, properties)
+}
+
+// SetUserMin 数值类型的用户属性取较小值, 属性值必须为数值
+func SetUserMin(properties map[string]interface{}) BigdataOptions {
+	return setUserOperation(UserMin, properties)
+}
+
+// SetUserMax 数值类型的用户属性取较大值, 属性值必须为数值
+func SetUserMax(properties map[string]interface{}) BigdataOptions {
+	return setUserOperation(UserMax, properties)
+}
+
+func setUserOperation(operation string, properties map[string]interface{}) BigdataOptions {
+	return func(logData *BigDataLog) error {
+		logData.Type = typeUser
+		logData.Event = operation
+		logData.setProperties(properties, false)
+		return checkUserOperation(logData)
+	}
+}
+
+// checkUserOperation 检查用户属性操作及其属性值类型
+func checkUserOperation(logData *BigDataLog) error {
+	if logData.Type != typeUser {
 		return nil
 	}
+	numeric, ok := userOperations[logData.Event]
+	if !ok {
+		return ErrInvalidUserOperation
+	}
+	if !numeric {
+		return nil
+	}
+	for k, v := range logData.Properties {
+		if _, ok := toFloat64(v); !ok {
+			return fmt.Errorf("%w: %s property %s must be number, got %T", ErrInvalidProperty, logData.Event, k, v)
+		}
+	}
+	return nil
 }
 
-// Tracks 大数据埋点事件上报
+// SetPriority 事件优先级
+// 高优先级事件使用独立的缓存 (容量为 BigDataConfig.HighCacheCapacity), 写入后立即上报且优先于普通事件上报,
+// 不会因普通事件过多而被丢弃; 配置了 BigDataConfig.DurableWriter 时同时写入该写入器
+func SetPriority(priority Priority) BigdataOptions {
+	return func(logData *BigDataLog) error {
+		logData.priority = priority
+		return nil
+	}
+}
+
+// Tracks 大数据埋点事件上报, 等同于 p.NewEvent().Device(devicecode).User(distinctID).Options(opts...).Send()
 //
 //	devicecode 设备码
 //	distinctID 用户标识, 通常为瑞雪 OpenID
 //	opts 埋点动态参数设置
 func (p *Producer) Tracks(devicecode, distinctID string, opts ...BigdataOptions) error {
-	if devicecode == "" && distinctID == "" {
-		return ErrInvalidDevicecode
+	return p.NewEvent().Device(devicecode).User(distinctID).Options(opts...).Send()
+}
+
+// TrackUserOperations 对同一用户一次提交多个用户属性操作, 任一操作校验失败则全部不上报
+//
+//	ops 用户属性操作, 如 SetUserSet, SetUserAdd 等
+//	opts 所有操作共用的埋点参数, 如 SetPreset
+func (p *Producer) TrackUserOperations(
+	devicecode, distinctID string, ops []BigdataOptions, opts ...BigdataOptions) error {
+	if len(ops) == 0 {
+		return ErrInvalidUserOperation
+	}
+	if p.isShutDown.Load() {
+		return errProducerShutdown
+	}
+	p.wg.Add(1)
+	defer p.wg.Done()
+
+	logs := make([]*BigDataLog, 0, len(ops))
+	for _, op := range ops {
+		logData, err := p.buildLog(devicecode, distinctID, append(opts[:len(opts):len(opts)], op)...)
+		if err == nil && logData != nil && logData.Type != typeUser {
+			logData.release()
+			err = ErrInvalidUserOperation
+		}
+		if err != nil {
+			releaseLogs(logs)
+			p.stats.addRejected(err)
+			return err
+		}
+		if logData == nil {
+			atomic.AddInt64(&p.stats.filtered, 1)
+			continue
+		}
+		logs = append(logs, logData)
+	}
+	// 校验全部通过后再记录 UUID, 避免校验失败时已记录的 UUID 导致调用方重试的事件被丢弃
+	accepted := logs[:0]
+	for _, logData := range logs {
+		if p.isDuplicate(logData) {
+			logData.release()
+			continue
+		}
+		accepted = append(accepted, logData)
 	}
+	logs = accepted
+	if len(logs) == 0 {
+		return nil
+	}
+	atomic.AddInt64(&p.stats.accepted, int64(len(logs)))
+	return p.write(logs...)
+}
+
+// track 完成事件构建并写入, 写入后事件由 LogWriter 持有
+func (p *Producer) track(logData *BigDataLog) error {
 	if p.isShutDown.Load() {
+		logData.release()
 		return errProducerShutdown
 	}
 	p.wg.Add(1)
 	defer p.wg.Done()
 
-	logData := &BigDataLog{
-		DistinctID: distinctID,
-		Devicecode: devicecode,
+	keep, err := p.completeLog(logData)
+	if err != nil {
+		logData.release()
+		p.stats.addRejected(err)
+		return err
+	}
+	if !keep {
+		logData.release()
+		atomic.AddInt64(&p.stats.filtered, 1)
+		return nil
+	}
+	if p.isDuplicate(logData) {
+		logData.release()
+		return nil
 	}
+	atomic.AddInt64(&p.stats.accepted, 1)
+	return p.write(logData)
+}
+
+// buildLog 根据埋点参数生成事件, 并完成默认值填充与校验
+// 事件被过滤或采样丢弃时返回 nil, nil
+func (p *Producer) buildLog(devicecode, distinctID string, opts ...BigdataOptions) (*BigDataLog, error) {
+	logData := newBigDataLog()
+	logData.DistinctID = distinctID
+	logData.Devicecode = devicecode
 	for _, opt := range opts {
 		err := opt(logData)
 		if err != nil {
-			return err
+			logData.release()
+			return nil, err
 		}
 	}
+	keep, err := p.completeLog(logData)
+	if err != nil || !keep {
+		logData.release()
+		return nil, err
+	}
+	return logData, nil
+}
+
+// completeLog 完成事件的默认值填充与校验, 事件被过滤或采样丢弃时返回 false
+func (p *Producer) completeLog(logData *BigDataLog) (bool, error) {
+	p.fillIdentity(logData)
+	if logData.Devicecode == "" && logData.DistinctID == "" {
+		return false, ErrInvalidDevicecode
+	}
 	if logData.Type == "" {
-		return ErrInvalidType
+		return false, ErrInvalidType
+	}
+	err := checkUserOperation(logData)
+	if err != nil {
+		return false, err
 	}
+	p.conf.resolvePropertyTimes(logData)
+	// 只校验调用方设置的属性, 公共属性不需要在每个事件定义中声明
+	err = p.conf.Schema.validate(logData)
+	if err != nil {
+		return false, err
+	}
+	p.applySuperProperties(logData)
 	if logData.CPID == 0 {
-		if config.CPID == 0 {
-			return ErrInvalidCPID
+		// 未调用 Init 时没有全局配置, 需要在事件上设置 CPID
+		if config == nil || config.CPID == 0 {
+			return false, ErrInvalidCPID
 		}
 		logData.CPID = config.CPID
 	}
@@ -153,18 +403,53 @@ func (p *Producer) Tracks(devicecode, distinctID string, opts ...BigdataOptions)
 	if logData.UUID == "" {
 		logData.UUID = uuid.New().String()
 	}
-	if logData.Time == "" {
-		logData.Time = time.Now().Format(time.RFC3339Nano)
+	err = p.conf.resolveTime(logData)
+	if err != nil {
+		return false, err
+	}
+	err = p.conf.normalize(logData)
+	if err != nil {
+		return false, err
+	}
+	if !p.conf.filter(logData) {
+		return false, nil
 	}
+	// 在 EventHook 之后处理, EventHook 添加或修改的属性同样需要处理
+	p.conf.redact(logData)
+	return true, nil
+}
 
-	return p.writer.Write(logData)
+// onClose 注册在 Close 时调用的函数, 调用时 Producer 仍可以上报事件
+func (p *Producer) onClose(fn func() error) {
+	p.closeMutex.Lock()
+	p.closers = append(p.closers, fn)
+	p.closeMutex.Unlock()
 }
 
 // Close 服务停止前必须显式调用该方法, 不然可能造成数据丢失
 func (p *Producer) Close() error {
+	p.closeMutex.Lock()
+	closers := p.closers
+	p.closers = nil
+	p.closeMutex.Unlock()
+	for _, fn := range closers {
+		if err := fn(); err != nil {
+			logger.Errorf("bigdata producer close: %s", err.Error())
+		}
+	}
+
 	p.isShutDown.Store(true)
 	p.wg.Wait()
-	return p.writer.Close()
+	err := p.writer.Close()
+	if p.conf.DurableWriter != nil {
+		if derr := p.conf.DurableWriter.Close(); err == nil {
+			err = derr
+		}
+	}
+	if serr := p.closeSinks(); err == nil {
+		err = serr
+	}
+	return err
 }
 
 func extractStringProperty(properties map[string]interface{}, key string) string {
@@ -191,6 +476,9 @@ func extractCPID(properties map[string]interface{}) uint32 {
 			return v
 		}
 	}
+	if config == nil {
+		return 0
+	}
 	return config.CPID
 }
 
@@ -202,15 +490,3 @@ func extractUUID(properties map[string]interface{}) string {
 	}
 	return uuid.New().String()
 }
-
-func extractTime(properties map[string]interface{}) string {
-	if t, ok := properties[PresetKeyTime]; ok {
-		switch v := t.(type) {
-		case string:
-			return v
-		case time.Time:
-			return v.Format(dateTimeFormat)
-		}
-	}
-	return time.Now().Format(dateTimeFormat)
-}
@@ -0,0 +1,300 @@
+// Copyright (c) 2022. Homeland Interactive Technology Ltd. All rights reserved.
+
+package ruixuego
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PropertyKeyAggWindow = "$agg_window" // 汇总周期, 单位秒
+	PropertyKeyAggCount  = "$agg_count"  // Incr 累加值与 Observe 次数之和
+	PropertyKeyAggSum    = "$agg_sum"    // Observe 记录值之和
+	PropertyKeyAggMin    = "$agg_min"    // Observe 记录的最小值
+	PropertyKeyAggMax    = "$agg_max"    // Observe 记录的最大值
+	PropertyKeyAggAvg    = "$agg_avg"    // Observe 记录值的平均值
+	propertyKeyAggPrefix = "$agg_p"      // 分位数属性前缀, 如 $agg_p50, $agg_p99_9
+
+	aggregatorDefaultInterval      = time.Minute
+	aggregatorDefaultReservoirSize = 1024
+	aggregatorDefaultMaxKeys       = 10000
+	aggregatorDefaultDevicecode    = "aggregator"
+)
+
+var aggregatorDefaultPercentiles = []float64{0.5, 0.9, 0.99}
+
+// AggregatorConfig 聚合指标配置
+type AggregatorConfig struct {
+	Interval      time.Duration `json:"interval"`       // 汇总上报间隔, 默认 1 分钟
+	Percentiles   []float64     `json:"percentiles"`    // 上报的分位数, 取值 (0, 1], 默认 0.5, 0.9, 0.99
+	ReservoirSize int           `json:"reservoir_size"` // 每个指标计算分位数时保留的采样数, 默认 1024
+	MaxKeys       int           `json:"max_keys"`       // 每个周期最多的指标数 (事件名与维度的组合), 超过后丢弃新指标, 默认 10000
+	Devicecode    string        `json:"devicecode"`     // 汇总事件的设备码, 默认为主机名
+	DistinctID    string        `json:"distinct_id"`    // 汇总事件的用户标识, 可为空
+	_done         bool
+}
+
+func (conf *AggregatorConfig) done() error {
+	if conf._done {
+		return nil
+	}
+	if conf.Interval <= 0 {
+		conf.Interval = aggregatorDefaultInterval
+	}
+	if conf.Percentiles == nil {
+		conf.Percentiles = aggregatorDefaultPercentiles
+	}
+	for _, q := range conf.Percentiles {
+		if q <= 0 || q > 1 {
+			return fmt.Errorf("%w: aggregator percentile %v", ErrInvalidParam, q)
+		}
+	}
+	if conf.ReservoirSize <= 0 {
+		conf.ReservoirSize = aggregatorDefaultReservoirSize
+	}
+	if conf.MaxKeys <= 0 {
+		conf.MaxKeys = aggregatorDefaultMaxKeys
+	}
+	if conf.Devicecode == "" {
+		conf.Devicecode, _ = os.Hostname()
+		if conf.Devicecode == "" {
+			conf.Devicecode = aggregatorDefaultDevicecode
+		}
+	}
+	conf._done = true
+	return nil
+}
+
+// metric 一个周期内某个事件名与维度组合的汇总数据
+type metric struct {
+	event     string
+	dims      map[string]interface{}
+	count     int64
+	observed  int64
+	sum       float64
+	min       float64
+	max       float64
+	reservoir []float64
+}
+
+// observe 记录一个值, 超过采样数后使用蓄水池抽样保留均匀分布的样本
+func (m *metric) observe(value float64, size int, rnd *rand.Rand) {
+	m.count++
+	m.observed++
+	m.sum += value
+	if m.observed == 1 || value < m.min {
+		m.min = value
+	}
+	if m.observed == 1 || value > m.max {
+		m.max = value
+	}
+	if len(m.reservoir) < size {
+		m.reservoir = append(m.reservoir, value)
+		return
+	}
+	if i := rnd.Int63n(m.observed); i < int64(size) {
+		m.reservoir[i] = value
+	}
+}
+
+// Aggregator 聚合指标, 按事件名与维度汇总计数和数值, 每个周期每个指标上报一条汇总事件
+//
+//	agg.Incr("match_start", map[string]interface{}{"mode": "rank"}, 1)
+//	agg.Observe("queue_time", map[string]interface{}{"mode": "rank"}, 3.2)
+//
+// 汇总事件的属性为维度加上 $agg_window, $agg_count, 有 Observe 记录时还包括
+// $agg_sum, $agg_min, $agg_max, $agg_avg 及分位数 $agg_p50 等, 事件时间为周期开始时间
+type Aggregator struct {
+	p         *Producer
+	conf      *AggregatorConfig
+	mutex     sync.Mutex
+	metrics   map[string]*metric
+	start     time.Time
+	dropped   int64
+	rnd       *rand.Rand
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewAggregator 创建聚合指标, Producer.Close 时会自动调用 Aggregator.Close 上报未到周期的数据
+func NewAggregator(p *Producer, conf *AggregatorConfig) (*Aggregator, error) {
+	if p == nil {
+		return nil, errBigDataNotConfigured
+	}
+	if conf == nil {
+		conf = &AggregatorConfig{}
+	}
+	err := conf.done()
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Aggregator{
+		p:       p,
+		conf:    conf,
+		metrics: make(map[string]*metric),
+		start:   time.Now(),
+		rnd:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		closed:  make(chan struct{}),
+	}
+	p.onClose(a.Close)
+
+	go func() {
+		ticker := time.NewTicker(conf.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				a.Flush()
+			case <-a.closed:
+				return
+			}
+		}
+	}()
+	return a, nil
+}
+
+// Incr 计数指标累加 n
+//
+//	event 汇总事件名
+//	dims (可为空) 维度, 作为汇总事件的属性, 维度不同的数据分别汇总
+//	n 累加值
+func (a *Aggregator) Incr(event string, dims map[string]interface{}, n int64) {
+	a.mutex.Lock()
+	if m := a.metric(event, dims); m != nil {
+		m.count += n
+	}
+	a.mutex.Unlock()
+}
+
+// Observe 记录一个数值, 用于统计总和, 最值, 平均值与分位数
+func (a *Aggregator) Observe(event string, dims map[string]interface{}, value float64) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return
+	}
+	a.mutex.Lock()
+	if m := a.metric(event, dims); m != nil {
+		m.observe(value, a.conf.ReservoirSize, a.rnd)
+	}
+	a.mutex.Unlock()
+}
+
+// metric 获取或创建指标, 指标数超过 MaxKeys 时返回 nil, 需持有锁调用
+func (a *Aggregator) metric(event string, dims map[string]interface{}) *metric {
+	key := metricKey(event, dims)
+	m, ok := a.metrics[key]
+	if ok {
+		return m
+	}
+	if len(a.metrics) >= a.conf.MaxKeys {
+		a.dropped++
+		return nil
+	}
+	m = &metric{event: event}
+	if len(dims) > 0 {
+		m.dims = make(map[string]interface{}, len(dims))
+		for k, v := range dims {
+			m.dims[k] = v
+		}
+	}
+	a.metrics[key] = m
+	return m
+}
+
+// metricKey 事件名与按 key 排序的维度组成指标的 key
+func metricKey(event string, dims map[string]interface{}) string {
+	if len(dims) == 0 {
+		return event
+	}
+	keys := make([]string, 0, len(dims))
+	for k := range dims {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	sb.WriteString(event)
+	for _, k := range keys {
+		sb.WriteByte(0)
+		sb.WriteString(k)
+		sb.WriteByte('=')
+		fmt.Fprint(&sb, dims[k])
+	}
+	return sb.String()
+}
+
+// Flush 立即上报当前周期的汇总事件并开始新的周期
+func (a *Aggregator) Flush() {
+	now := time.Now()
+	a.mutex.Lock()
+	metrics, start, dropped := a.metrics, a.start, a.dropped
+	a.metrics = make(map[string]*metric, len(metrics))
+	a.start, a.dropped = now, 0
+	a.mutex.Unlock()
+
+	if dropped > 0 {
+		logger.Errorf("bigdata aggregator dropped %d records, more than %d metrics", dropped, a.conf.MaxKeys)
+	}
+	window := math.Round(now.Sub(start).Seconds()*1000) / 1000
+	for _, m := range metrics {
+		err := a.send(m, start, window)
+		if err != nil {
+			logger.Errorf("bigdata aggregator send %s failed: %s", m.event, err.Error())
+		}
+	}
+}
+
+func (a *Aggregator) send(m *metric, start time.Time, window float64) error {
+	b := a.p.Event(m.event).Device(a.conf.Devicecode).User(a.conf.DistinctID).Time(start).
+		Props(m.dims).
+		Prop(PropertyKeyAggWindow, window).
+		Prop(PropertyKeyAggCount, m.count)
+	if m.observed == 0 {
+		return b.Send()
+	}
+
+	b.Prop(PropertyKeyAggSum, m.sum).
+		Prop(PropertyKeyAggMin, m.min).
+		Prop(PropertyKeyAggMax, m.max).
+		Prop(PropertyKeyAggAvg, m.sum/float64(m.observed))
+	sort.Float64s(m.reservoir)
+	for _, q := range a.conf.Percentiles {
+		b.Prop(percentileKey(q), percentile(m.reservoir, q))
+	}
+	return b.Send()
+}
+
+// percentileKey 分位数的属性名, 如 0.5 为 $agg_p50, 0.999 为 $agg_p99_9
+func percentileKey(q float64) string {
+	s := strconv.FormatFloat(math.Round(q*100000)/1000, 'f', -1, 64)
+	return propertyKeyAggPrefix + strings.Replace(s, ".", "_", 1)
+}
+
+// percentile 使用最近秩方法计算已排序样本的分位数
+func percentile(sorted []float64, q float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// Close 停止定时汇总并上报当前周期的数据
+func (a *Aggregator) Close() error {
+	a.closeOnce.Do(func() {
+		close(a.closed)
+		a.Flush()
+	})
+	return nil
+}
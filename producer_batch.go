@@ -3,32 +3,72 @@
 package ruixuego
 
 import (
+	"math/rand"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/google/uuid"
+	"github.com/ruixueyun/ruixuego/bufferpool"
 )
 
-func newBatchWriter(t TrackInterface, conf *BigDataConfig) *batchWriter {
-	return &batchWriter{
+func newBatchWriter(t TrackInterface, conf *BigDataConfig, stats *producerStats) *batchWriter {
+	bw := &batchWriter{
 		conf:           conf,
 		trackInterface: t,
-		bufferMutex:    new(sync.RWMutex),
+		stats:          stats,
 		buffer:         make([]*BigDataLog, 0, conf.BatchSize),
-		cacheMutex:     new(sync.RWMutex),
-		cache:          make([]*BigDataLog, 0, conf.BatchSize*2),
+		normal:         logLane{logs: make([]*BigDataLog, 0, conf.BatchSize*2), capacity: conf.CacheCapacity},
+		high:           logLane{capacity: conf.HighCacheCapacity, high: true},
+		unhealthy:      &Bool{},
 		closed:         make(chan struct{}, 1),
 	}
+	if conf.OrderByDistinctID {
+		bw.inflight = make(map[string]int)
+	}
+	bw.idle = sync.NewCond(&bw.mutex)
+	return bw
 }
 
+// batchWriter 批量上报瑞雪云
+// 数据先写入 buffer, 满一批或有待上报数据时按优先级转入缓存, 由最多 UploadWorkers 个并发上报任务从缓存取批次上报,
+// 高优先级缓存中的数据先于普通缓存上报, 上报失败的批次按写入顺序放回原缓存等待重试
 type batchWriter struct {
 	conf           *BigDataConfig
 	trackInterface TrackInterface
-	bufferMutex    *sync.RWMutex
+	stats          *producerStats
+	dropped        func(logs []*BigDataLog) // 数据未上报就被丢弃时调用, 可以为 nil
+	mutex          sync.Mutex
+	idle           *sync.Cond // 有上报任务结束时通知
 	buffer         []*BigDataLog
-	cacheMutex     *sync.RWMutex
-	cache          []*BigDataLog
-	gzipPool       *gzipPool
+	normal         logLane        // 普通优先级数据的缓存
+	high           logLane        // 高优先级数据的缓存, 与普通缓存分别计算容量
+	inflight       map[string]int // 正在上报的 DistinctID 及条数, 仅 OrderByDistinctID 时使用
+	uploading      int            // 正在上报的批次数
+	seq            uint64
 	closed         chan struct{}
+
+	// 上报失败后由 retryTimer 按指数退避重试, 期间 unhealthy 为 true, 不再由 Write 触发上报
+	unhealthy  *Bool
+	retryMutex sync.Mutex
+	retryTimer *time.Timer
+	failures   int
+}
+
+// logLane 一个优先级的待上报数据
+type logLane struct {
+	logs     []*BigDataLog // 按 seq 排序
+	inflight int           // 正在上报的条数, 计入缓存容量
+	capacity int
+	high     bool
+}
+
+func (bw *batchWriter) lane(logData *BigDataLog) *logLane {
+	if logData.priority == PriorityHigh {
+		return &bw.high
+	}
+	return &bw.normal
 }
 
 func (bw *batchWriter) Init() error {
@@ -41,6 +81,10 @@ func (bw *batchWriter) Init() error {
 		for {
 			select {
 			case <-ticker.C:
+				if bw.unhealthy.Load() {
+					bw.spill()
+					continue
+				}
 				err := bw.Flush()
 				if err != nil {
 					logger.Errorf(err.Error())
@@ -53,86 +97,442 @@ func (bw *batchWriter) Init() error {
 	return nil
 }
 
-func (bw *batchWriter) Write(logData *BigDataLog) error {
-	bw.bufferMutex.Lock()
-	bw.buffer = append(bw.buffer, logData)
-	bw.bufferMutex.Unlock()
+func (bw *batchWriter) Write(logs ...*BigDataLog) error {
+	bw.mutex.Lock()
+	for _, logData := range logs {
+		bw.seq++
+		logData.seq = bw.seq
+	}
+	bw.buffer = append(bw.buffer, logs...)
+	full, pending := len(bw.buffer) >= bw.conf.BatchSize, len(bw.normal.logs) > 0 || len(bw.high.logs) > 0
+	for _, logData := range logs {
+		if logData.priority == PriorityHigh {
+			// 高优先级数据立即转入缓存并上报
+			full = true
+			break
+		}
+	}
+	if bw.unhealthy.Load() {
+		// 上报接口不可用时由重试调度负责上报, 这里只将已满的缓冲转入缓存以限制内存占用
+		if full {
+			bw.moveBuffer()
+		}
+		bw.mutex.Unlock()
+		return nil
+	}
+	idle := bw.uploading < bw.conf.UploadWorkers
+	bw.mutex.Unlock()
 
-	if bw.bufferLength() >= bw.conf.BatchSize || bw.cacheLength() > 0 {
+	if !full && !pending {
+		return nil
+	}
+	if bw.conf.UploadWorkers == 1 {
 		return bw.Flush()
 	}
+	// 多个并发上报任务时异步上报, 调用方不等待上报结果
+	if idle {
+		go func() {
+			err := bw.Flush()
+			if err != nil {
+				logger.Errorf(err.Error())
+			}
+		}()
+	}
 	return nil
 }
 
+// Flush 将缓冲转入缓存, 并发上报最多 UploadWorkers 批数据, 失败的数据保留在缓存中等待重试
 func (bw *batchWriter) Flush() error {
-	bw.bufferMutex.Lock()
-	bw.cacheMutex.Lock()
-	defer bw.cacheMutex.Unlock()
+	bw.mutex.Lock()
+	bw.moveBuffer()
+	batches := bw.takeBatches()
+	bw.mutex.Unlock()
+
+	return bw.upload(batches)
+}
+
+func (bw *batchWriter) Close() error {
+	close(bw.closed)
+
+	bw.retryMutex.Lock()
+	if bw.retryTimer != nil {
+		bw.retryTimer.Stop()
+		bw.retryTimer = nil
+	}
+	bw.retryMutex.Unlock()
+
+	err := bw.drain()
+	if err != nil {
+		// 关闭后不再重试, 剩余的数据被丢弃
+		bw.mutex.Lock()
+		bw.drop(bw.buffer)
+		bw.drop(bw.normal.logs)
+		bw.drop(bw.high.logs)
+		bw.mutex.Unlock()
+	}
+	return err
+}
+
+// drain 连续上报直到缓冲与缓存清空且没有正在上报的批次, 或上报失败
+func (bw *batchWriter) drain() error {
+	for {
+		bw.mutex.Lock()
+		bw.moveBuffer()
+		batches := bw.takeBatches()
+		if len(batches) == 0 {
+			if len(bw.normal.logs) == 0 && len(bw.high.logs) == 0 && bw.uploading == 0 {
+				bw.mutex.Unlock()
+				return nil
+			}
+			// 其他任务正在上报, 等待其结束后再取批次
+			bw.idle.Wait()
+			bw.mutex.Unlock()
+			continue
+		}
+		bw.mutex.Unlock()
 
-	if len(bw.cache) == 0 && len(bw.buffer) == 0 {
-		bw.bufferMutex.Unlock()
+		err := bw.upload(batches)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// spill 将缓冲中的数据转入缓存, 不上报
+func (bw *batchWriter) spill() {
+	bw.mutex.Lock()
+	bw.moveBuffer()
+	bw.mutex.Unlock()
+}
+
+// moveBuffer 将缓冲中的数据按优先级转入缓存, 调用方需持有 mutex
+func (bw *batchWriter) moveBuffer() {
+	if len(bw.buffer) == 0 {
+		return
+	}
+	for i, logData := range bw.buffer {
+		lane := bw.lane(logData)
+		lane.logs = append(lane.logs, logData)
+		bw.buffer[i] = nil
+	}
+	bw.buffer = bw.buffer[:0]
+	bw.trimCache(&bw.normal)
+	bw.trimCache(&bw.high)
+}
+
+// trimCache 缓存与正在上报的数据超出容量时丢弃缓存中最早的数据, 调用方需持有 mutex
+func (bw *batchWriter) trimCache(lane *logLane) {
+	n := len(lane.logs) + lane.inflight - lane.capacity
+	if n <= 0 {
+		return
+	}
+	if n > len(lane.logs) {
+		n = len(lane.logs)
+	}
+	bw.drop(lane.logs[:n])
+	releaseLogs(lane.logs[:n])
+	removeFromCache(lane, lane.logs[n:])
+	atomic.AddInt64(&bw.stats.evicted, int64(n))
+	if lane.high {
+		atomic.AddInt64(&bw.stats.evictedHigh, int64(n))
+	}
+}
+
+// drop 通知 dropped 这些数据未上报就被丢弃
+func (bw *batchWriter) drop(logs []*BigDataLog) {
+	if bw.dropped != nil && len(logs) > 0 {
+		bw.dropped(logs)
+	}
+}
+
+// takeBatches 从缓存中取出最多 UploadWorkers-uploading 批数据, 先取高优先级数据, 调用方需持有 mutex
+func (bw *batchWriter) takeBatches() [][]*BigDataLog {
+	var batches [][]*BigDataLog
+	for bw.uploading < bw.conf.UploadWorkers {
+		lane := &bw.high
+		batch := bw.takeBatch(lane)
+		if len(batch) == 0 {
+			lane = &bw.normal
+			batch = bw.takeBatch(lane)
+		}
+		if len(batch) == 0 {
+			break
+		}
+		bw.uploading++
+		lane.inflight += len(batch)
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// takeBatch 从缓存中取出一批数据, 同一批数据的路由相同, 由第一条可上报的数据决定
+// 开启 OrderByDistinctID 时跳过正在上报或路由不同的 DistinctID, 同一 DistinctID 被跳过后其后续数据也会被跳过, 以保证上报顺序
+func (bw *batchWriter) takeBatch(lane *logLane) []*BigDataLog {
+	size := bw.conf.BatchSize
+	if size > len(lane.logs) {
+		size = len(lane.logs)
+	}
+	if size == 0 {
 		return nil
 	}
+	batch := make([]*BigDataLog, 0, size)
+
+	if bw.inflight == nil && sameRoute(lane.logs[:size]) {
+		batch = append(batch, lane.logs[:size]...)
+		removeFromCache(lane, lane.logs[size:])
+		return batch
+	}
 
-	defer func() {
-		if len(bw.cache) > bw.conf.CacheCapacity {
-			bw.cache = append(bw.cache[:0], bw.cache[len(bw.cache)-bw.conf.CacheCapacity:]...)
+	var (
+		route   routeKey
+		skipped map[string]struct{}
+	)
+	keep := lane.logs[:0] // 原地过滤, 写入位置不会超过读取位置
+	for i, logData := range lane.logs {
+		if len(batch) == size {
+			keep = append(keep, lane.logs[i:]...)
+			break
 		}
-	}()
+		skip := len(batch) > 0 && logData.route() != route
+		if bw.inflight != nil {
+			key := orderKey(logData)
+			if _, ok := skipped[key]; ok {
+				skip = true
+			} else if skip || bw.inflight[key] > 0 {
+				if skipped == nil {
+					skipped = make(map[string]struct{})
+				}
+				skipped[key] = struct{}{}
+				skip = true
+			}
+		}
+		if skip {
+			keep = append(keep, logData)
+			continue
+		}
+		if len(batch) == 0 {
+			route = logData.route()
+		}
+		batch = append(batch, logData)
+	}
+	if bw.inflight != nil {
+		for _, logData := range batch {
+			bw.inflight[orderKey(logData)]++
+		}
+	}
+	removeFromCache(lane, keep)
+	return batch
+}
 
-	if len(bw.cache) == 0 || len(bw.buffer) >= bw.conf.BatchSize {
-		bw.cache = append(bw.cache, bw.buffer...)
-		bw.buffer = bw.buffer[:0]
+func sameRoute(logs []*BigDataLog) bool {
+	for i := 1; i < len(logs); i++ {
+		if logs[i].route() != logs[0].route() {
+			return false
+		}
 	}
-	bw.bufferMutex.Unlock()
+	return true
+}
 
-	n := len(bw.cache)
-	if n > bw.conf.BatchSize {
-		n = bw.conf.BatchSize
+// removeFromCache 用 keep 替换缓存内容, keep 可以与缓存共用底层数组
+func removeFromCache(lane *logLane, keep []*BigDataLog) {
+	remain := copy(lane.logs, keep)
+	for i := remain; i < len(lane.logs); i++ {
+		lane.logs[i] = nil
 	}
-	b, err := MarshalJSON(bw.cache[:n])
-	if err != nil {
-		return err
+	lane.logs = lane.logs[:remain]
+}
+
+// upload 并发上报多批数据, 返回第一个错误
+func (bw *batchWriter) upload(batches [][]*BigDataLog) error {
+	if len(batches) == 0 {
+		return nil
+	}
+	errs := make([]error, len(batches))
+	var wg sync.WaitGroup
+	for i := 1; i < len(batches); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = bw.send(batches[i])
+		}(i)
 	}
+	errs[0] = bw.send(batches[0])
+	wg.Wait()
 
-	code := 0
-	for i := 0; i < 3; i++ {
-		code, err = bw.trackInterface.Track(&ReqTrack{
-			Data:     b,
-			LogCount: n,
-			Compress: !bw.conf.DisableCompress,
-		})
+	for _, err := range errs {
 		if err != nil {
-			logger.Errorf("failed to send Track log: [%d] %s, data: %s", code, err.Error(), b)
-			if code != http.StatusOK {
-				continue
-			}
 			return err
-		} else {
-			bw.cache = append(bw.cache[:0], bw.cache[n:]...)
-			break
 		}
 	}
-	return err
+	return nil
 }
 
-func (bw *batchWriter) Close() error {
-	close(bw.closed)
-	err := bw.Flush()
+// send 上报一批数据并处理结果
+func (bw *batchWriter) send(batch []*BigDataLog) error {
+	code, size, compressed, err := bw.track(batch)
+
+	bw.mutex.Lock()
+	lane := bw.lane(batch[0])
+	bw.uploading--
+	lane.inflight -= len(batch)
+	if bw.inflight != nil {
+		for _, logData := range batch {
+			key := orderKey(logData)
+			if bw.inflight[key] <= 1 {
+				delete(bw.inflight, key)
+			} else {
+				bw.inflight[key]--
+			}
+		}
+	}
 	if err != nil {
+		lane.logs = mergeBySeq(batch, lane.logs)
+		bw.trimCache(lane)
+	}
+	bw.idle.Broadcast()
+	bw.mutex.Unlock()
+
+	if err != nil {
+		bw.stats.uploadFailed(len(batch), size, compressed, err)
+		bw.uploadFailed(code)
 		return err
 	}
+	bw.stats.uploadSucceeded(len(batch), size, compressed)
+	bw.uploadSucceeded()
+	releaseLogs(batch)
 	return nil
 }
 
-func (bw *batchWriter) bufferLength() int {
-	bw.bufferMutex.RLock()
-	defer bw.bufferMutex.RUnlock()
-	return len(bw.buffer)
+// track 编码并上报一批数据, 返回状态码及压缩前后的字节数
+func (bw *batchWriter) track(batch []*BigDataLog) (code, size, compressed int, err error) {
+	buf := bufferpool.Get()
+	defer bufferpool.Put(buf)
+
+	size, err = encodeBatch(buf, bw.conf.codec, batch)
+	if err != nil {
+		return defaultStatus, size, buf.Len(), err
+	}
+
+	data := buf.Bytes()
+	if _, ok := bw.trackInterface.(*Client); !ok {
+		// 缓冲在上报后放回 bufferpool, 自定义的 TrackInterface 可能在 Track 返回后继续持有 Data, 需要复制一份
+		data = append([]byte(nil), data...)
+	}
+	track := &ReqTrack{
+		Data:     data,
+		LogCount: len(batch),
+		Encoding: bw.conf.codec.Encoding(),
+		TraceID:  uuid.New().String(),
+	}
+	batch[0].route().setHeader(&track.ReqHeader)
+	start := time.Now()
+	code, err = bw.trackInterface.Track(track)
+	if bw.conf.Verbose {
+		logger.Infof("bigdata track batch: count=%d, bytes=%d, compressed=%d, traceid=%s, latency=%s, code=%d, error=%v",
+			len(batch), size, buf.Len(), track.TraceID, time.Since(start), code, err)
+	}
+	if err != nil {
+		b, _ := MarshalJSON(batch)
+		logger.Errorf("failed to send Track log: [%d] %s, data: %s", code, err.Error(), bw.conf.redactLog(b))
+	}
+	return code, size, buf.Len(), err
+}
+
+// mergeBySeq 按 seq 合并两个已排序的数据列表
+func mergeBySeq(a, b []*BigDataLog) []*BigDataLog {
+	ret := make([]*BigDataLog, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if a[i].seq <= b[j].seq {
+			ret = append(ret, a[i])
+			i++
+		} else {
+			ret = append(ret, b[j])
+			j++
+		}
+	}
+	ret = append(ret, a[i:]...)
+	return append(ret, b[j:]...)
+}
+
+// orderKey 保证上报顺序时使用的用户标识
+func orderKey(logData *BigDataLog) string {
+	if logData.DistinctID != "" {
+		return logData.DistinctID
+	}
+	return logData.Devicecode
+}
+
+// uploadFailed 标记上报接口不可用并按指数退避安排重试
+func (bw *batchWriter) uploadFailed(code int) {
+	bw.retryMutex.Lock()
+	defer bw.retryMutex.Unlock()
+
+	bw.failures++
+	if bw.unhealthy.CAS(false, true) {
+		logger.Errorf("bigdata track endpoint unhealthy: [%d] %s", code, http.StatusText(code))
+	}
+	if bw.retryTimer != nil || bw.isClosed() {
+		return
+	}
+	bw.retryTimer = time.AfterFunc(bw.backoff(bw.failures), bw.retry)
+}
+
+// uploadSucceeded 上报成功后立即恢复正常上报
+func (bw *batchWriter) uploadSucceeded() {
+	if !bw.unhealthy.Load() {
+		return
+	}
+	bw.retryMutex.Lock()
+	defer bw.retryMutex.Unlock()
+
+	bw.failures = 0
+	if bw.unhealthy.CAS(true, false) {
+		logger.Infof("bigdata track endpoint recovered")
+	}
+}
+
+// retry 重试上报, 成功后继续上报积压的数据
+func (bw *batchWriter) retry() {
+	bw.retryMutex.Lock()
+	bw.retryTimer = nil
+	bw.retryMutex.Unlock()
+
+	if bw.isClosed() {
+		return
+	}
+	err := bw.drain()
+	if err != nil {
+		logger.Errorf("bigdata track retry failed: %s", err.Error())
+	}
+}
+
+// backoff 计算第 n 次失败后的重试间隔, 在指数退避的基础上增加 ±50% 的随机抖动
+func (bw *batchWriter) backoff(n int) time.Duration {
+	d := bw.conf.RetryMaxInterval
+	if n < 32 {
+		if e := bw.conf.RetryInterval << uint(n-1); e > 0 && e < d {
+			d = e
+		}
+	}
+	d = d/2 + time.Duration(rand.Int63n(int64(d)+1))
+	if d > bw.conf.RetryMaxInterval {
+		d = bw.conf.RetryMaxInterval
+	}
+	return d
+}
+
+func (bw *batchWriter) isClosed() bool {
+	select {
+	case <-bw.closed:
+		return true
+	default:
+		return false
+	}
 }
 
-func (bw *batchWriter) cacheLength() int {
-	bw.cacheMutex.RLock()
-	defer bw.cacheMutex.RUnlock()
-	return len(bw.cache)
+func (bw *batchWriter) bufferStats() (inBuffer, inCache int) {
+	bw.mutex.Lock()
+	defer bw.mutex.Unlock()
+	return len(bw.buffer), len(bw.normal.logs) + bw.normal.inflight + len(bw.high.logs) + bw.high.inflight
 }
@@ -0,0 +1,419 @@
+// Copyright (c) 2022. Homeland Interactive Technology Ltd. All rights reserved.
+
+package ruixuego
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errTestTrack = errors.New("test track failed")
+
+// testTracker 记录上报数据的 TrackInterface, fail 为 true 时上报失败
+type testTracker struct {
+	mutex sync.Mutex
+	calls int
+	fail  bool
+	logs  []*BigDataLog
+}
+
+func (tt *testTracker) Track(track *ReqTrack) (int, error) {
+	tt.mutex.Lock()
+	defer tt.mutex.Unlock()
+	tt.calls++
+	if tt.fail {
+		return http.StatusServiceUnavailable, errTestTrack
+	}
+	logs, err := DecodeTrack(track)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	tt.logs = append(tt.logs, logs...)
+	return http.StatusOK, nil
+}
+
+func (tt *testTracker) setFail(fail bool) {
+	tt.mutex.Lock()
+	tt.fail = fail
+	tt.mutex.Unlock()
+}
+
+func (tt *testTracker) callCount() int {
+	tt.mutex.Lock()
+	defer tt.mutex.Unlock()
+	return tt.calls
+}
+
+func (tt *testTracker) events() []string {
+	tt.mutex.Lock()
+	defer tt.mutex.Unlock()
+	ret := make([]string, len(tt.logs))
+	for i, logData := range tt.logs {
+		ret[i] = logData.Event
+	}
+	return ret
+}
+
+func newTestBatchWriter(t *testing.T, tt TrackInterface, conf *BigDataConfig) *batchWriter {
+	t.Helper()
+	conf.done()
+	if err := conf.check(); err != nil {
+		t.Fatal(err)
+	}
+	bw := newBatchWriter(tt, conf, &producerStats{})
+	if err := bw.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return bw
+}
+
+func testLog(event, distinctID string) *BigDataLog {
+	return &BigDataLog{Type: typeTrack, Event: event, Devicecode: "d-" + distinctID, DistinctID: distinctID}
+}
+
+// waitFor 等待 cond 成立, 超时后测试失败
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func cacheSeqs(bw *batchWriter) []uint64 {
+	bw.mutex.Lock()
+	defer bw.mutex.Unlock()
+	ret := make([]uint64, len(bw.normal.logs))
+	for i, logData := range bw.normal.logs {
+		ret[i] = logData.seq
+	}
+	return ret
+}
+
+func TestBatchWriterNoFlushWhileUnhealthy(t *testing.T) {
+	tt := &testTracker{fail: true}
+	bw := newTestBatchWriter(t, tt, &BigDataConfig{BatchSize: 1, RetryInterval: time.Hour})
+
+	if err := bw.Write(testLog("e0", "u")); err == nil {
+		t.Fatal("want error")
+	}
+	if !bw.unhealthy.Load() {
+		t.Fatal("want unhealthy")
+	}
+	for i := 1; i < 10; i++ {
+		if err := bw.Write(testLog(fmt.Sprintf("e%d", i), "u")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := tt.callCount(); n != 1 {
+		t.Errorf("got %d track calls while unhealthy, want 1", n)
+	}
+	if _, inCache := bw.bufferStats(); inCache != 10 {
+		t.Errorf("got %d logs in cache, want 10", inCache)
+	}
+}
+
+func TestBatchWriterBackoff(t *testing.T) {
+	bw := newTestBatchWriter(t, &testTracker{}, &BigDataConfig{
+		RetryInterval:    100 * time.Millisecond,
+		RetryMaxInterval: time.Second,
+	})
+	for n := 1; n <= 40; n++ {
+		base := bw.conf.RetryMaxInterval
+		if n < 32 {
+			if e := bw.conf.RetryInterval << uint(n-1); e > 0 && e < base {
+				base = e
+			}
+		}
+		for i := 0; i < 100; i++ {
+			d := bw.backoff(n)
+			if d < base/2 || d > base*3/2 || d > bw.conf.RetryMaxInterval {
+				t.Fatalf("backoff(%d) = %s, want [%s, %s] and <= %s", n, d, base/2, base*3/2, bw.conf.RetryMaxInterval)
+			}
+		}
+	}
+}
+
+func TestBatchWriterRecover(t *testing.T) {
+	tt := &testTracker{fail: true}
+	bw := newTestBatchWriter(t, tt, &BigDataConfig{
+		BatchSize:        1,
+		RetryInterval:    10 * time.Millisecond,
+		RetryMaxInterval: 20 * time.Millisecond,
+	})
+	defer bw.Close()
+
+	bw.Write(testLog("e0", "u"))
+	bw.Write(testLog("e1", "u"))
+	if !bw.unhealthy.Load() {
+		t.Fatal("want unhealthy")
+	}
+
+	tt.setFail(false)
+	waitFor(t, time.Second, func() bool { return len(tt.events()) == 2 })
+	if bw.unhealthy.Load() {
+		t.Fatal("want healthy after one success")
+	}
+
+	// 恢复后由 Write 直接上报
+	calls := tt.callCount()
+	if err := bw.Write(testLog("e2", "u")); err != nil {
+		t.Fatal(err)
+	}
+	if n := tt.callCount(); n != calls+1 {
+		t.Errorf("got %d track calls, want %d", n, calls+1)
+	}
+	if got := fmt.Sprint(tt.events()); got != "[e0 e1 e2]" {
+		t.Errorf("got events %s", got)
+	}
+}
+
+func TestBatchWriterRequeueInOrder(t *testing.T) {
+	tt := &testTracker{fail: true}
+	bw := newTestBatchWriter(t, tt, &BigDataConfig{BatchSize: 2, UploadWorkers: 3, RetryInterval: time.Hour})
+
+	// 标记为不可用, 数据只转入缓存不上报
+	bw.unhealthy.Store(true)
+	for i := 0; i < 7; i++ {
+		bw.Write(testLog(fmt.Sprintf("e%d", i), "u"))
+	}
+	// 同时上报的 3 批全部失败, 按写入顺序放回缓存
+	if err := bw.Flush(); err == nil {
+		t.Fatal("want error")
+	}
+	if got := fmt.Sprint(cacheSeqs(bw)); got != "[1 2 3 4 5 6 7]" {
+		t.Fatalf("got cache seqs %s", got)
+	}
+
+	tt.setFail(false)
+	bw.unhealthy.Store(false)
+	if err := bw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	events := tt.events()
+	if len(events) != 7 {
+		t.Fatalf("got %d events, want 7", len(events))
+	}
+}
+
+// flakyTracker 按比例随机上报失败的 TrackInterface
+type flakyTracker struct {
+	testTracker
+	rand *rand.Rand
+	rate float64
+}
+
+func (ft *flakyTracker) Track(track *ReqTrack) (int, error) {
+	ft.mutex.Lock()
+	if ft.rand.Float64() < ft.rate {
+		ft.calls++
+		ft.mutex.Unlock()
+		return http.StatusServiceUnavailable, errTestTrack
+	}
+	ft.mutex.Unlock()
+	return ft.testTracker.Track(track)
+}
+
+func (ft *flakyTracker) setRate(rate float64) {
+	ft.mutex.Lock()
+	ft.rate = rate
+	ft.mutex.Unlock()
+}
+
+// TestBatchWriterOrderByDistinctID 并发上报且随机失败时, 同一 DistinctID 的数据仍按写入顺序上报
+func TestBatchWriterOrderByDistinctID(t *testing.T) {
+	ft := &flakyTracker{rand: rand.New(rand.NewSource(time.Now().UnixNano())), rate: 0.3}
+	bw := newTestBatchWriter(t, ft, &BigDataConfig{
+		BatchSize:         5,
+		CacheCapacity:     10000,
+		UploadWorkers:     4,
+		OrderByDistinctID: true,
+		RetryInterval:     time.Millisecond,
+		RetryMaxInterval:  5 * time.Millisecond,
+	})
+
+	const users, perUser = 6, 200
+	var wg sync.WaitGroup
+	for u := 0; u < users; u++ {
+		wg.Add(1)
+		go func(u int) {
+			defer wg.Done()
+			for i := 0; i < perUser; i++ {
+				logData := testLog("e", fmt.Sprintf("u%d", u))
+				logData.Properties = map[string]interface{}{"n": i}
+				bw.Write(logData)
+			}
+		}(u)
+	}
+	wg.Wait()
+
+	ft.setRate(0)
+	waitFor(t, 10*time.Second, func() bool {
+		if err := bw.Flush(); err != nil {
+			return false
+		}
+		_, inCache := bw.bufferStats()
+		return inCache == 0
+	})
+	if err := bw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+	if len(ft.logs) != users*perUser {
+		t.Fatalf("got %d logs, want %d", len(ft.logs), users*perUser)
+	}
+	next := make(map[string]int)
+	for _, logData := range ft.logs {
+		n := fmt.Sprint(logData.Properties["n"])
+		if want := fmt.Sprint(next[logData.DistinctID]); n != want {
+			t.Fatalf("%s: got n=%s, want %s", logData.DistinctID, n, want)
+		}
+		next[logData.DistinctID]++
+	}
+}
+
+// retainTracker 在 Track 返回后继续持有 ReqTrack.Data
+type retainTracker struct {
+	mutex sync.Mutex
+	data  [][]byte
+	track []*ReqTrack
+}
+
+func (rt *retainTracker) Track(track *ReqTrack) (int, error) {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+	rt.track = append(rt.track, track)
+	rt.data = append(rt.data, append([]byte(nil), track.Data...))
+	return http.StatusOK, nil
+}
+
+func TestBatchWriterCopiesDataForCustomTrack(t *testing.T) {
+	rt := &retainTracker{}
+	bw := newTestBatchWriter(t, rt, &BigDataConfig{BatchSize: 1})
+	for i := 0; i < 20; i++ {
+		if err := bw.Write(testLog(fmt.Sprintf("e%d", i), "u")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for i, track := range rt.track {
+		if string(track.Data) != string(rt.data[i]) {
+			t.Fatalf("batch %d: Data changed after Track returned", i)
+		}
+	}
+}
+
+// TestProducerHighPriority 上报接口不可用期间大量普通事件不会挤掉高优先级事件, 恢复后高优先级事件先上报并写入 DurableWriter
+func TestProducerHighPriority(t *testing.T) {
+	setTestConfig(t, &Config{CPID: 1})
+	tt := &testTracker{fail: true}
+	durable := &captureWriter{}
+	p, err := NewProducer(tt, &BigDataConfig{
+		BatchSize:         5,
+		CacheCapacity:     10,
+		HighCacheCapacity: 10,
+		RetryInterval:     time.Hour,
+		DurableWriter:     durable,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		var err error
+		switch i {
+		case 10:
+			err = p.Tracks("d", "u", SetEvent("pay"), SetPriority(PriorityHigh))
+		case 50, 90:
+			err = p.Event("pay").Device("d").User("u").Priority(PriorityHigh).Send()
+		default:
+			err = p.Tracks("d", "u", SetEvent("normal"))
+		}
+		if err != nil && !errors.Is(err, errTestTrack) {
+			t.Fatal(err)
+		}
+	}
+	stats := p.Stats()
+	if stats.Evicted == 0 || stats.EvictedHighPriority != 0 {
+		t.Errorf("got evicted %d, evicted high priority %d", stats.Evicted, stats.EvictedHighPriority)
+	}
+
+	tt.setFail(false)
+	if err = p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	events := tt.events()
+	if len(events) < 3 || fmt.Sprint(events[:3]) != "[pay pay pay]" {
+		t.Fatalf("got events %v, want high priority events first", events)
+	}
+	for _, event := range events[3:] {
+		if event != "normal" {
+			t.Fatalf("got events %v", events)
+		}
+	}
+
+	written := durable.written()
+	if len(written) != 3 {
+		t.Fatalf("got %d durable events, want 3", len(written))
+	}
+	for _, logData := range written {
+		if logData.Event != "pay" {
+			t.Errorf("got durable event %s, want pay", logData.Event)
+		}
+	}
+}
+
+// TestProducerDedupEvicted 因缓存已满被丢弃的事件不保留去重记录, 可以重新提交
+func TestProducerDedupEvicted(t *testing.T) {
+	setTestConfig(t, &Config{CPID: 1})
+	tt := &testTracker{fail: true}
+	p, err := NewProducer(tt, &BigDataConfig{
+		BatchSize:     1,
+		CacheCapacity: 1,
+		RetryInterval: time.Hour,
+		DedupWindow:   time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	track := func(uuid string) {
+		t.Helper()
+		err := p.Tracks("d", "u", SetEvent(uuid), SetPreset(map[string]interface{}{PresetKeyUUID: uuid}))
+		if err != nil && !errors.Is(err, errTestTrack) {
+			t.Fatal(err)
+		}
+	}
+	track("x1")
+	track("x2")
+	track("x3")
+	if stats := p.Stats(); stats.Evicted != 2 {
+		t.Fatalf("got evicted %d, want 2", stats.Evicted)
+	}
+
+	// x3 仍在缓存中, x1 已被丢弃可以重新提交
+	track("x3")
+	track("x1")
+	if stats := p.Stats(); stats.Deduplicated != 1 {
+		t.Errorf("got deduplicated %d, want 1", stats.Deduplicated)
+	}
+
+	// 关闭时上报失败, 剩余的数据同样不保留去重记录
+	if err = p.Close(); err == nil {
+		t.Fatal("want error")
+	}
+	if p.dedup.Len() != 0 {
+		t.Errorf("got %d uuids in dedup window after Close, want 0", p.dedup.Len())
+	}
+}
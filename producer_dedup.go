@@ -0,0 +1,31 @@
+// Copyright (c) 2022. Homeland Interactive Technology Ltd. All rights reserved.
+
+package ruixuego
+
+import "sync/atomic"
+
+// isDuplicate 开启去重时判断事件的 UUID 是否已在去重窗口内接收过, 未接收过时记录该 UUID
+// 事件的 UUID 在构建时确定, 上报失败重试的是同一批事件, 不会生成新的 UUID
+func (p *Producer) isDuplicate(logData *BigDataLog) bool {
+	if p.dedup == nil {
+		return false
+	}
+	if p.dedup.SetIfAbsent(logData.UUID, struct{}{}) {
+		return false
+	}
+	atomic.AddInt64(&p.stats.deduplicated, 1)
+	if p.conf.Verbose {
+		logger.Infof("bigdata drop duplicated event: event=%s, uuid=%s", logData.Event, logData.UUID)
+	}
+	return true
+}
+
+// forgetDuplicates 删除事件在去重窗口内的记录
+func (p *Producer) forgetDuplicates(logs []*BigDataLog) {
+	if p.dedup == nil {
+		return
+	}
+	for _, logData := range logs {
+		p.dedup.Delete(logData.UUID)
+	}
+}
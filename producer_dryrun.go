@@ -0,0 +1,43 @@
+// Copyright (c) 2022. Homeland Interactive Technology Ltd. All rights reserved.
+
+package ruixuego
+
+// DryRunHandler 调试模式下的事件处理函数, 函数返回后不能继续持有 logs
+type DryRunHandler func(logs []*BigDataLog)
+
+func newDryRunWriter(conf *BigDataConfig) *dryRunWriter {
+	return &dryRunWriter{handler: conf.DryRunHandler}
+}
+
+// dryRunWriter 调试模式写入器, 不上报数据, 只将构建好的事件交给处理函数或输出到日志
+type dryRunWriter struct {
+	handler DryRunHandler
+}
+
+func (w *dryRunWriter) Init() error {
+	return nil
+}
+
+func (w *dryRunWriter) Write(logs ...*BigDataLog) error {
+	defer releaseLogs(logs)
+	if w.handler != nil {
+		w.handler(logs)
+		return nil
+	}
+	for _, logData := range logs {
+		b, err := MarshalJSON(logData)
+		if err != nil {
+			return err
+		}
+		logger.Infof("bigdata dry run: %s", b)
+	}
+	return nil
+}
+
+func (w *dryRunWriter) Flush() error {
+	return nil
+}
+
+func (w *dryRunWriter) Close() error {
+	return nil
+}
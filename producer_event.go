@@ -0,0 +1,208 @@
+// Copyright (c) 2022. Homeland Interactive Technology Ltd. All rights reserved.
+
+package ruixuego
+
+import "sync"
+
+var eventBuilderPool = sync.Pool{New: func() interface{} { return &EventBuilder{} }}
+
+// EventBuilder 埋点事件构建器, 事件与属性 map 均从对象池获取, 用于替代 BigdataOptions 减少内存分配
+//
+//	err := p.Event("login").Device(devicecode).User(openID).Prop("level", 10).Send()
+//
+// 构建过程中的错误在 Send 时返回, Send 后不能继续使用该构建器
+type EventBuilder struct {
+	p   *Producer
+	log *BigDataLog
+	err error
+}
+
+// NewEvent 创建未设置事件类型的构建器, 需通过 Options 或 Preset 等方法设置事件类型
+func (p *Producer) NewEvent() *EventBuilder {
+	b := eventBuilderPool.Get().(*EventBuilder)
+	b.p = p
+	b.log = newBigDataLog()
+	return b
+}
+
+// Event 创建普通事件的构建器, 同 SetEvent
+func (p *Producer) Event(event string) *EventBuilder {
+	return p.NewEvent().setEvent(typeTrack, event)
+}
+
+// UpdateEvent 创建可更新事件的构建器, 同 SetUpdateEvent
+func (p *Producer) UpdateEvent(event string) *EventBuilder {
+	return p.NewEvent().setEvent(typeUpdateTrack, event)
+}
+
+// FirstEvent 创建首次事件的构建器, 同 SetFirstEvent
+func (p *Producer) FirstEvent(event string) *EventBuilder {
+	return p.NewEvent().setEvent(typeFirstTrack, event)
+}
+
+// UserEvent 创建用户属性操作的构建器, updateType 为 UserSet, UserSetOnce, UserAdd, UserMin, UserMax
+func (p *Producer) UserEvent(updateType string) *EventBuilder {
+	return p.NewEvent().setEvent(typeUser, updateType)
+}
+
+func (b *EventBuilder) setEvent(typ, event string) *EventBuilder {
+	b.setErr(setEvent(b.log, typ, event))
+	return b
+}
+
+func (b *EventBuilder) setErr(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+// Device 设置设备码
+func (b *EventBuilder) Device(devicecode string) *EventBuilder {
+	b.log.Devicecode = devicecode
+	return b
+}
+
+// User 设置用户标识, 通常为瑞雪 OpenID
+func (b *EventBuilder) User(distinctID string) *EventBuilder {
+	b.log.DistinctID = distinctID
+	return b
+}
+
+// Prop 设置一个自定义属性
+func (b *EventBuilder) Prop(key string, value interface{}) *EventBuilder {
+	b.ownProperties()
+	b.log.Properties[key] = value
+	return b
+}
+
+// Props 设置多个自定义属性, 属性会被复制, 调用方可以继续修改 properties
+func (b *EventBuilder) Props(properties map[string]interface{}) *EventBuilder {
+	if len(properties) == 0 {
+		return b
+	}
+	b.ownProperties()
+	for k, v := range properties {
+		b.log.Properties[k] = v
+	}
+	return b
+}
+
+// Struct 使用结构体设置自定义属性, 转换规则见 StructProperties
+func (b *EventBuilder) Struct(v interface{}) *EventBuilder {
+	properties, err := StructProperties(v)
+	if err != nil {
+		b.setErr(err)
+		return b
+	}
+	b.log.structTimes = true
+	if b.log.Properties == nil {
+		b.log.setProperties(properties, true)
+		return b
+	}
+	return b.Props(properties)
+}
+
+func (b *EventBuilder) ownProperties() {
+	if b.log.Properties == nil {
+		b.log.setProperties(newProperties(), true)
+		return
+	}
+	b.log.copyProperties()
+}
+
+// Preset 设置预置属性, 同 SetPreset
+func (b *EventBuilder) Preset(preset map[string]interface{}) *EventBuilder {
+	b.setErr(applyPreset(b.log, preset))
+	return b
+}
+
+// CPID 设置 CPID, 为 0 时使用 Config.CPID
+func (b *EventBuilder) CPID(cpID uint32) *EventBuilder {
+	b.log.CPID = cpID
+	return b
+}
+
+// PlatformID 设置平台 ID
+func (b *EventBuilder) PlatformID(platformID int32) *EventBuilder {
+	b.log.PlatformID = platformID
+	return b
+}
+
+// ProductID 设置产品 ID
+func (b *EventBuilder) ProductID(productID string) *EventBuilder {
+	b.log.ProductID = productID
+	return b
+}
+
+// ChannelID 设置渠道 ID
+func (b *EventBuilder) ChannelID(channelID string) *EventBuilder {
+	b.log.ChannelID = channelID
+	return b
+}
+
+// SubChannelID 设置子渠道 ID
+func (b *EventBuilder) SubChannelID(subChannelID string) *EventBuilder {
+	b.log.SubChannelID = subChannelID
+	return b
+}
+
+// IP 设置 IP
+func (b *EventBuilder) IP(ip string) *EventBuilder {
+	b.log.IP = ip
+	return b
+}
+
+// UUID 设置事件唯一标识, 为空时自动生成
+func (b *EventBuilder) UUID(uuid string) *EventBuilder {
+	b.log.UUID = uuid
+	return b
+}
+
+// Time 设置事件时间, 支持的类型同 PresetKeyTime
+func (b *EventBuilder) Time(t interface{}) *EventBuilder {
+	b.log.rawTime = t
+	return b
+}
+
+// Region 设置上报请求头中的区域, 为空时使用 Config.Region
+func (b *EventBuilder) Region(region string) *EventBuilder {
+	b.log.region = region
+	return b
+}
+
+// ServiceMark 设置上报请求头中的区服标识, 为空时使用 Config.ServiceMark
+func (b *EventBuilder) ServiceMark(serviceMark string) *EventBuilder {
+	b.log.serviceMark = serviceMark
+	return b
+}
+
+// Priority 设置事件优先级, 同 SetPriority
+func (b *EventBuilder) Priority(priority Priority) *EventBuilder {
+	b.log.priority = priority
+	return b
+}
+
+// Options 应用 BigdataOptions 埋点参数
+func (b *EventBuilder) Options(opts ...BigdataOptions) *EventBuilder {
+	for _, opt := range opts {
+		if b.err != nil {
+			break
+		}
+		b.setErr(opt(b.log))
+	}
+	return b
+}
+
+// Send 完成构建并上报事件, 校验失败时返回错误
+func (b *EventBuilder) Send() error {
+	p, logData, err := b.p, b.log, b.err
+	b.p, b.log, b.err = nil, nil, nil
+	eventBuilderPool.Put(b)
+
+	if err != nil {
+		logData.release()
+		p.stats.addRejected(err)
+		return err
+	}
+	return p.track(logData)
+}
@@ -0,0 +1,370 @@
+// Copyright (c) 2022. Homeland Interactive Technology Ltd. All rights reserved.
+
+package ruixuego
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	fileWriterDefaultFilename      = "bigdata.log"
+	fileWriterDefaultMaxSize       = 100 << 20   // 默认单个文件 100MB
+	fileWriterDefaultFlushInterval = time.Second // 默认每秒刷盘
+	fileWriterRotateTimeFormat     = "20060102T150405.000"
+	fileWriterCompressSuffix       = ".gz"
+)
+
+// FileWriterConfig 本地日志文件配置
+type FileWriterConfig struct {
+	Dir            string        `json:"dir"`             // 日志目录
+	Filename       string        `json:"filename"`        // 当前写入的文件名, 默认 bigdata.log
+	MaxSize        int64         `json:"max_size"`        // 单个文件最大字节数, 超过后轮转, 默认 100MB
+	RotateInterval time.Duration `json:"rotate_interval"` // 按时间轮转的间隔, 为 0 时不按时间轮转
+	FlushInterval  time.Duration `json:"flush_interval"`  // 写缓冲刷盘间隔, 默认 1 秒
+	Compress       bool          `json:"compress"`        // 是否使用 gzip 压缩轮转后的文件
+	MaxBackups     int           `json:"max_backups"`     // 最多保留的轮转文件数, 为 0 时不限制
+	MaxAge         time.Duration `json:"max_age"`         // 轮转文件最长保留时间, 为 0 时不限制
+	_done          bool
+}
+
+func (conf *FileWriterConfig) done() {
+	if conf._done {
+		return
+	}
+	if conf.Filename == "" {
+		conf.Filename = fileWriterDefaultFilename
+	}
+	if conf.MaxSize <= 0 {
+		conf.MaxSize = fileWriterDefaultMaxSize
+	}
+	if conf.FlushInterval <= 0 {
+		conf.FlushInterval = fileWriterDefaultFlushInterval
+	}
+	conf._done = true
+}
+
+// NewFileWriter 创建本地日志文件写入器, 每行一条 JSON 格式的埋点数据, 格式与 Track 上报的数据一致
+// 配置到 BigDataConfig.Writer 后, 埋点数据将写入本地文件, 由日志采集程序负责上报
+func NewFileWriter(conf *FileWriterConfig) *FileWriter {
+	conf.done()
+	return &FileWriter{
+		conf:   conf,
+		closed: make(chan struct{}),
+	}
+}
+
+// FileWriter 本地日志文件写入器, 支持按大小和时间轮转, 压缩及清理轮转后的文件
+type FileWriter struct {
+	conf         *FileWriterConfig
+	mutex        sync.Mutex
+	file         *os.File
+	writer       *bufio.Writer
+	size         int64
+	openedAt     time.Time
+	closed       chan struct{}
+	closeOnce    sync.Once
+	wg           sync.WaitGroup // 轮转后的压缩与清理任务
+	cleanupMutex sync.Mutex
+}
+
+// Init 打开日志文件并启动定时刷盘
+func (fw *FileWriter) Init() error {
+	err := os.MkdirAll(fw.conf.Dir, 0o755)
+	if err != nil {
+		return err
+	}
+
+	fw.mutex.Lock()
+	err = fw.open()
+	fw.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(fw.conf.FlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				err := fw.Flush()
+				if err != nil {
+					logger.Errorf("bigdata file writer flush failed: %s", err.Error())
+				}
+			case <-fw.closed:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Write 写入埋点数据, 每条一行
+func (fw *FileWriter) Write(logs ...*BigDataLog) error {
+	defer releaseLogs(logs)
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+
+	err := fw.ensureOpen()
+	if err != nil {
+		return err
+	}
+	for _, logData := range logs {
+		b, err := MarshalJSON(logData)
+		if err != nil {
+			return err
+		}
+		if fw.needRotate(int64(len(b) + 1)) {
+			err = fw.rotate()
+			if err != nil {
+				return err
+			}
+		}
+		n, err := fw.writer.Write(b)
+		fw.size += int64(n)
+		if err != nil {
+			return err
+		}
+		err = fw.writer.WriteByte('\n')
+		if err != nil {
+			return err
+		}
+		fw.size++
+	}
+	return nil
+}
+
+// Flush 将写缓冲刷入文件, 到达轮转时间时轮转文件
+func (fw *FileWriter) Flush() error {
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+
+	err := fw.ensureOpen()
+	if err == errProducerShutdown {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fw.needRotate(0) {
+		return fw.rotate()
+	}
+	return fw.writer.Flush()
+}
+
+// Close 刷盘并关闭文件, 等待轮转文件的压缩与清理完成
+func (fw *FileWriter) Close() error {
+	var err error
+	fw.closeOnce.Do(func() {
+		close(fw.closed)
+
+		fw.mutex.Lock()
+		if fw.file != nil {
+			err = fw.writer.Flush()
+			if cerr := fw.file.Close(); err == nil {
+				err = cerr
+			}
+			fw.file = nil
+		}
+		fw.mutex.Unlock()
+
+		fw.wg.Wait()
+	})
+	return err
+}
+
+func (fw *FileWriter) filename() string {
+	return filepath.Join(fw.conf.Dir, fw.conf.Filename)
+}
+
+// ensureOpen 轮转后未能打开新文件时重新打开, 已关闭时返回 errProducerShutdown, 调用方需持有 mutex
+func (fw *FileWriter) ensureOpen() error {
+	if fw.file != nil {
+		return nil
+	}
+	select {
+	case <-fw.closed:
+		return errProducerShutdown
+	default:
+	}
+	return fw.open()
+}
+
+func (fw *FileWriter) open() error {
+	f, err := os.OpenFile(fw.filename(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	fw.file = f
+	fw.size = info.Size()
+	fw.openedAt = time.Now()
+	if fw.writer == nil {
+		fw.writer = bufio.NewWriter(f)
+	} else {
+		fw.writer.Reset(f)
+	}
+	return nil
+}
+
+// needRotate 写入 n 字节前是否需要轮转, 空文件不轮转
+func (fw *FileWriter) needRotate(n int64) bool {
+	if fw.size == 0 {
+		return false
+	}
+	if fw.size+n > fw.conf.MaxSize {
+		return true
+	}
+	return fw.conf.RotateInterval > 0 && time.Since(fw.openedAt) >= fw.conf.RotateInterval
+}
+
+// rotate 关闭当前文件并重命名为带时间戳的文件名, 然后打开新文件
+// 关闭或重命名失败时重新打开当前文件继续写入; 打开新文件失败时由下次 Write 或 Flush 重试
+func (fw *FileWriter) rotate() error {
+	err := fw.writer.Flush()
+	if err != nil {
+		return err
+	}
+	err = fw.file.Close()
+	fw.file = nil
+	if err != nil {
+		return fw.reopen(err)
+	}
+
+	backup := fw.backupName()
+	err = os.Rename(fw.filename(), backup)
+	if err != nil {
+		return fw.reopen(err)
+	}
+
+	fw.wg.Add(1)
+	go func() {
+		defer fw.wg.Done()
+		if fw.conf.Compress {
+			if err := compressFile(backup); err != nil {
+				logger.Errorf("bigdata file writer compress %s failed: %s", backup, err.Error())
+			}
+		}
+		fw.cleanup()
+	}()
+	return fw.open()
+}
+
+// reopen 轮转失败后重新打开当前文件, 返回轮转的错误
+func (fw *FileWriter) reopen(err error) error {
+	if oerr := fw.open(); oerr != nil {
+		logger.Errorf("bigdata file writer reopen %s failed: %s", fw.filename(), oerr.Error())
+	}
+	return err
+}
+
+// backupPrefixAndExt 轮转文件名为 {prefix}{时间戳}{ext}, 如 /data/bigdata-20220101T000000.000.log
+func (fw *FileWriter) backupPrefixAndExt() (string, string) {
+	ext := filepath.Ext(fw.conf.Filename)
+	return filepath.Join(fw.conf.Dir, strings.TrimSuffix(fw.conf.Filename, ext)+"-"), ext
+}
+
+// backupName 返回未被使用的轮转文件名
+// 同一毫秒内多次轮转时追加序号, 如 bigdata-20220101T000000.000_001.log, 按字典序排在不带序号的文件之后
+func (fw *FileWriter) backupName() string {
+	prefix, ext := fw.backupPrefixAndExt()
+	base := prefix + time.Now().Format(fileWriterRotateTimeFormat)
+	name := base + ext
+	for i := 1; backupExists(name); i++ {
+		name = fmt.Sprintf("%s_%03d%s", base, i, ext)
+	}
+	return name
+}
+
+// backupExists 轮转文件或其压缩文件 (包括正在压缩的临时文件) 是否存在
+func backupExists(name string) bool {
+	for _, n := range []string{name, name + fileWriterCompressSuffix, name + fileWriterCompressSuffix + ".tmp"} {
+		if _, err := os.Lstat(n); !os.IsNotExist(err) {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanup 按数量与保留时间清理轮转后的文件
+func (fw *FileWriter) cleanup() {
+	if fw.conf.MaxBackups <= 0 && fw.conf.MaxAge <= 0 {
+		return
+	}
+	fw.cleanupMutex.Lock()
+	defer fw.cleanupMutex.Unlock()
+
+	prefix, ext := fw.backupPrefixAndExt()
+	matches, err := filepath.Glob(prefix + "*")
+	if err != nil {
+		logger.Errorf("bigdata file writer cleanup failed: %s", err.Error())
+		return
+	}
+	backups := matches[:0]
+	for _, name := range matches {
+		if strings.HasSuffix(name, ext) || strings.HasSuffix(name, ext+fileWriterCompressSuffix) {
+			backups = append(backups, name)
+		}
+	}
+	// 文件名中的时间戳可以直接按字典序排序, 新文件在前
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+
+	for i, name := range backups {
+		remove := fw.conf.MaxBackups > 0 && i >= fw.conf.MaxBackups
+		if !remove && fw.conf.MaxAge > 0 {
+			info, err := os.Stat(name)
+			remove = err == nil && time.Since(info.ModTime()) > fw.conf.MaxAge
+		}
+		if !remove {
+			continue
+		}
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			logger.Errorf("bigdata file writer remove %s failed: %s", name, err.Error())
+		}
+	}
+}
+
+// compressFile 将文件压缩为 {name}.gz 并删除原文件
+func compressFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := name + fileWriterCompressSuffix + ".tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	gw := gzip.NewWriter(dst)
+	_, err = io.Copy(gw, src)
+	if err == nil {
+		err = gw.Close()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	err = os.Rename(tmp, name+fileWriterCompressSuffix)
+	if err != nil {
+		return err
+	}
+	return os.Remove(name)
+}
@@ -0,0 +1,154 @@
+// Copyright (c) 2022. Homeland Interactive Technology Ltd. All rights reserved.
+
+package ruixuego
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countBackupLines 统计目录中所有日志文件 (含压缩文件) 的行数, 并检查没有空文件
+func countBackupLines(t *testing.T, dir string) (files, lines int) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		name := filepath.Join(dir, entry.Name())
+		if strings.HasSuffix(name, ".tmp") {
+			t.Fatalf("temporary file left: %s", name)
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r io.Reader = f
+		if strings.HasSuffix(name, fileWriterCompressSuffix) {
+			gr, err := gzip.NewReader(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r = gr
+		}
+		n := 0
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			n++
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 && entry.Name() != fileWriterDefaultFilename {
+			t.Errorf("empty backup %s", entry.Name())
+		}
+		files++
+		lines += n
+	}
+	return files, lines
+}
+
+// TestFileWriterRotateSameMillisecond 同一毫秒内多次轮转不会覆盖之前的轮转文件
+func TestFileWriterRotateSameMillisecond(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		dir := t.TempDir()
+		fw := NewFileWriter(&FileWriterConfig{Dir: dir, MaxSize: 64, Compress: compress})
+		if err := fw.Init(); err != nil {
+			t.Fatal(err)
+		}
+		const total = 200
+		for i := 0; i < total; i++ {
+			err := fw.Write(&BigDataLog{Type: typeTrack, Event: "e", Devicecode: "d"})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := fw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		files, lines := countBackupLines(t, dir)
+		if lines != total {
+			t.Errorf("compress=%v: got %d lines in %d files, want %d", compress, lines, files, total)
+		}
+		if files < total/2 {
+			t.Errorf("compress=%v: got %d files, want one rotation per write", compress, files)
+		}
+	}
+}
+
+// TestFileWriterNoRotateEmptyFile 到达轮转时间时不会轮转空文件
+func TestFileWriterNoRotateEmptyFile(t *testing.T) {
+	dir := t.TempDir()
+	fw := NewFileWriter(&FileWriterConfig{Dir: dir, RotateInterval: time.Millisecond})
+	if err := fw.Init(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if err := fw.Write(&BigDataLog{Type: typeTrack, Event: "e", Devicecode: "d"}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if err := fw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, lines := countBackupLines(t, dir)
+	if lines != 1 {
+		t.Errorf("got %d lines, want 1", lines)
+	}
+	// 第一次写入时文件为空不轮转, Flush 时轮转出一个文件并打开新的空文件
+	if files != 2 {
+		t.Errorf("got %d files, want 2", files)
+	}
+}
+
+// TestFileWriterRotateFailure 轮转失败时返回实际的错误, 之后继续写入
+func TestFileWriterRotateFailure(t *testing.T) {
+	dir := t.TempDir()
+	fw := NewFileWriter(&FileWriterConfig{Dir: dir, MaxSize: 64})
+	if err := fw.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+
+	if err := fw.Write(&BigDataLog{Type: typeTrack, Event: "e", Devicecode: "d"}); err != nil {
+		t.Fatal(err)
+	}
+	// 删除当前文件使重命名失败
+	if err := os.Remove(fw.filename()); err != nil {
+		t.Fatal(err)
+	}
+	err := fw.Write(&BigDataLog{Type: typeTrack, Event: "e", Devicecode: "d"})
+	if !os.IsNotExist(err) {
+		t.Fatalf("got %v, want rename error", err)
+	}
+	if err = fw.Write(&BigDataLog{Type: typeTrack, Event: "e", Devicecode: "d"}); err != nil {
+		t.Fatalf("write after failed rotation: %v", err)
+	}
+
+	// 打开新文件失败后由下次写入重新打开
+	fw.mutex.Lock()
+	fw.file.Close()
+	fw.file = nil
+	fw.mutex.Unlock()
+	if err = fw.Write(&BigDataLog{Type: typeTrack, Event: "e", Devicecode: "d"}); err != nil {
+		t.Fatalf("write after failed open: %v", err)
+	}
+	if err = fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = fw.Write(&BigDataLog{Type: typeTrack, Event: "e", Devicecode: "d"}); err != errProducerShutdown {
+		t.Fatalf("got %v after Close, want errProducerShutdown", err)
+	}
+}
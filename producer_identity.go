@@ -0,0 +1,75 @@
+// Copyright (c) 2022. Homeland Interactive Technology Ltd. All rights reserved.
+
+package ruixuego
+
+// Identify 用户登录后关联设备码, 用户标识与 CP 用户 ID
+// 上报一条 user_set 事件, cpUserID 不为空时设置用户属性 $cp_user_id
+// 开启 BigDataConfig.IdentityCacheSize 时记录设备码与用户标识的关联, 之后只传设备码的事件自动填充该用户标识
+//
+//	devicecode 设备码
+//	distinctID 用户标识, 通常为瑞雪 OpenID
+//	cpUserID (可为空) CP 用户 ID
+//	opts 其他埋点参数设置, 如 SetPreset
+func (p *Producer) Identify(devicecode, distinctID, cpUserID string, opts ...BigdataOptions) error {
+	if devicecode == "" || distinctID == "" {
+		return ErrInvalidDevicecode
+	}
+	b := p.UserEvent(UserSet).Device(devicecode).User(distinctID).Options(opts...)
+	if cpUserID != "" {
+		b.Prop(PropertyKeyCPUserID, cpUserID)
+	}
+	err := b.Send()
+	if err != nil {
+		return err
+	}
+	p.rememberIdentity(devicecode, distinctID)
+	return nil
+}
+
+// Alias 将游客的设备码关联到用户标识
+// 上报一条 user_setonce 事件, 设置用户属性 $first_devicecode, 即用户首次使用的设备码
+// 开启 BigDataConfig.IdentityCacheSize 时记录设备码与用户标识的关联
+func (p *Producer) Alias(devicecode, distinctID string, opts ...BigdataOptions) error {
+	if devicecode == "" || distinctID == "" {
+		return ErrInvalidDevicecode
+	}
+	err := p.UserEvent(UserSetOnce).Device(devicecode).User(distinctID).Options(opts...).
+		Prop(PropertyKeyFirstDevicecode, devicecode).Send()
+	if err != nil {
+		return err
+	}
+	p.rememberIdentity(devicecode, distinctID)
+	return nil
+}
+
+// ForgetIdentity 删除设备码关联的用户标识, 如用户退出登录时
+func (p *Producer) ForgetIdentity(devicecode string) {
+	if p.identities != nil {
+		p.identities.Delete(devicecode)
+	}
+}
+
+// IdentityOf 返回设备码关联的用户标识, 未开启关联缓存或没有关联时返回空
+func (p *Producer) IdentityOf(devicecode string) string {
+	if p.identities == nil || devicecode == "" {
+		return ""
+	}
+	if v, ok := p.identities.Get(devicecode); ok {
+		return v.(string)
+	}
+	return ""
+}
+
+func (p *Producer) rememberIdentity(devicecode, distinctID string) {
+	if p.identities != nil {
+		p.identities.Set(devicecode, distinctID)
+	}
+}
+
+// fillIdentity 事件只有设备码时填充已关联的用户标识
+func (p *Producer) fillIdentity(logData *BigDataLog) {
+	if logData.DistinctID != "" || logData.Devicecode == "" || p.identities == nil {
+		return
+	}
+	logData.DistinctID = p.IdentityOf(logData.Devicecode)
+}
@@ -0,0 +1,319 @@
+// Copyright (c) 2022. Homeland Interactive Technology Ltd. All rights reserved.
+
+package ruixuego
+
+import (
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	EventSessionStart = "session_start" // 会话开始事件
+	EventSessionEnd   = "session_end"   // 会话结束事件
+
+	PropertyKeySessionID       = "$session_id"       // 会话 ID
+	PropertyKeySessionDuration = "$session_duration" // 会话时长, 单位秒, 精确到毫秒
+	PropertyKeySessionReason   = "$session_reason"   // 会话结束原因: logout, timeout, close
+
+	SessionEndLogout  = "logout"  // 调用 SessionEnd 结束
+	SessionEndTimeout = "timeout" // 超过 IdleTimeout 没有活动
+	SessionEndClose   = "close"   // 未配置 StateFile 时 Close 结束所有会话
+
+	sessionDefaultIdleTimeout = 30 * time.Minute
+	sessionMaxCheckInterval   = time.Minute
+)
+
+// SessionConfig 会话统计配置
+type SessionConfig struct {
+	IdleTimeout   time.Duration `json:"idle_timeout"`   // 超过该时间没有活动时结束会话, 默认 30 分钟
+	CheckInterval time.Duration `json:"check_interval"` // 检查超时会话的间隔, 默认 IdleTimeout 的 1/10, 最长 1 分钟
+	StateFile     string        `json:"state_file"`     // Close 时将未结束的会话保存到该文件, 启动时恢复; 为空时 Close 结束所有会话
+	StartEvent    string        `json:"start_event"`    // 会话开始事件名, 默认 session_start
+	EndEvent      string        `json:"end_event"`      // 会话结束事件名, 默认 session_end
+	_done         bool
+}
+
+func (conf *SessionConfig) done() {
+	if conf._done {
+		return
+	}
+	if conf.IdleTimeout <= 0 {
+		conf.IdleTimeout = sessionDefaultIdleTimeout
+	}
+	if conf.CheckInterval <= 0 {
+		conf.CheckInterval = conf.IdleTimeout / 10
+		if conf.CheckInterval > sessionMaxCheckInterval {
+			conf.CheckInterval = sessionMaxCheckInterval
+		}
+	}
+	if conf.StartEvent == "" {
+		conf.StartEvent = EventSessionStart
+	}
+	if conf.EndEvent == "" {
+		conf.EndEvent = EventSessionEnd
+	}
+	conf._done = true
+}
+
+// session 未结束的会话, 保存到 StateFile 时使用 JSON 格式
+type session struct {
+	ID         string    `json:"id"`
+	DistinctID string    `json:"distinct_id"`
+	Devicecode string    `json:"devicecode"`
+	Start      time.Time `json:"start"`
+	LastActive time.Time `json:"last_active"`
+}
+
+func (s *session) duration(end time.Time) float64 {
+	d := end.Sub(s.Start)
+	if d < 0 {
+		d = 0
+	}
+	return math.Round(d.Seconds()*1000) / 1000
+}
+
+// SessionTracker 会话统计, 根据用户活动上报会话开始与结束事件
+//
+//	用户首次活动时上报 session_start
+//	调用 SessionEnd 或超过 IdleTimeout 没有活动时上报 session_end, 带有会话时长 $session_duration
+//	超时结束的会话以最后一次活动的时间作为结束时间
+//
+// 两个事件均带有 $session_id, 会话按用户标识区分
+type SessionTracker struct {
+	p         *Producer
+	conf      *SessionConfig
+	mutex     sync.Mutex
+	sessions  map[string]*session
+	closed    chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// NewSessionTracker 创建会话统计, 配置了 StateFile 时恢复上次 Close 保存的会话
+// Producer.Close 时会自动调用 SessionTracker.Close, 需在 Producer 关闭前创建
+func NewSessionTracker(p *Producer, conf *SessionConfig) (*SessionTracker, error) {
+	if p == nil {
+		return nil, errBigDataNotConfigured
+	}
+	if conf == nil {
+		conf = &SessionConfig{}
+	}
+	conf.done()
+
+	st := &SessionTracker{
+		p:        p,
+		conf:     conf,
+		sessions: make(map[string]*session),
+		closed:   make(chan struct{}),
+	}
+	err := st.load()
+	if err != nil {
+		return nil, err
+	}
+	p.onClose(st.Close)
+
+	go func() {
+		ticker := time.NewTicker(conf.CheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				st.expire(now)
+			case <-st.closed:
+				return
+			}
+		}
+	}()
+	return st, nil
+}
+
+// SessionHeartbeat 记录用户活动, 用户没有进行中的会话时开始新会话并上报 session_start
+//
+//	distinctID 用户标识, 通常为瑞雪 OpenID
+//	devicecode 设备码
+//	opts 其他埋点参数设置, 只用于 session_start 事件
+func (st *SessionTracker) SessionHeartbeat(distinctID, devicecode string, opts ...BigdataOptions) error {
+	if distinctID == "" {
+		return ErrInvalidDevicecode
+	}
+	now := time.Now()
+
+	st.mutex.Lock()
+	s, ok := st.sessions[distinctID]
+	if ok && now.Sub(s.LastActive) <= st.conf.IdleTimeout {
+		s.LastActive = now
+		if devicecode != "" {
+			s.Devicecode = devicecode
+		}
+		st.mutex.Unlock()
+		return nil
+	}
+	var expired *session
+	if ok {
+		// 已超时但还未被检查到的会话
+		expired = s
+	}
+	s = &session{
+		ID:         uuid.New().String(),
+		DistinctID: distinctID,
+		Devicecode: devicecode,
+		Start:      now,
+		LastActive: now,
+	}
+	st.sessions[distinctID] = s
+	st.mutex.Unlock()
+
+	if expired != nil {
+		st.end(expired, expired.LastActive, SessionEndTimeout)
+	}
+	err := st.p.Event(st.conf.StartEvent).Device(s.Devicecode).User(distinctID).Time(s.Start).
+		Options(opts...).Prop(PropertyKeySessionID, s.ID).Send()
+	if err != nil {
+		st.mutex.Lock()
+		if st.sessions[distinctID] == s {
+			delete(st.sessions, distinctID)
+		}
+		st.mutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+// SessionEnd 结束用户的会话并上报 session_end, 如用户退出登录时; 用户没有进行中的会话时不上报
+//
+//	distinctID 用户标识, 通常为瑞雪 OpenID
+//	opts 其他埋点参数设置, 只用于 session_end 事件
+func (st *SessionTracker) SessionEnd(distinctID string, opts ...BigdataOptions) error {
+	st.mutex.Lock()
+	s, ok := st.sessions[distinctID]
+	if ok {
+		delete(st.sessions, distinctID)
+	}
+	st.mutex.Unlock()
+	if !ok {
+		return nil
+	}
+
+	end, reason := time.Now(), SessionEndLogout
+	if end.Sub(s.LastActive) > st.conf.IdleTimeout {
+		end, reason = s.LastActive, SessionEndTimeout
+	}
+	return st.end(s, end, reason, opts...)
+}
+
+// Sessions 返回进行中的会话数
+func (st *SessionTracker) Sessions() int {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	return len(st.sessions)
+}
+
+// Close 停止检查超时会话
+// 配置了 StateFile 时将进行中的会话保存到文件, 下次启动时恢复, 否则结束所有会话并上报 session_end
+func (st *SessionTracker) Close() error {
+	st.closeOnce.Do(func() {
+		close(st.closed)
+		st.expire(time.Now())
+		if st.conf.StateFile != "" {
+			st.closeErr = st.save()
+			return
+		}
+
+		st.mutex.Lock()
+		sessions := st.sessions
+		st.sessions = make(map[string]*session)
+		st.mutex.Unlock()
+		now := time.Now()
+		for _, s := range sessions {
+			st.end(s, now, SessionEndClose)
+		}
+	})
+	return st.closeErr
+}
+
+// expire 结束超时的会话
+func (st *SessionTracker) expire(now time.Time) {
+	var expired []*session
+	st.mutex.Lock()
+	for id, s := range st.sessions {
+		if now.Sub(s.LastActive) > st.conf.IdleTimeout {
+			expired = append(expired, s)
+			delete(st.sessions, id)
+		}
+	}
+	st.mutex.Unlock()
+
+	for _, s := range expired {
+		st.end(s, s.LastActive, SessionEndTimeout)
+	}
+}
+
+func (st *SessionTracker) end(s *session, end time.Time, reason string, opts ...BigdataOptions) error {
+	err := st.p.Event(st.conf.EndEvent).Device(s.Devicecode).User(s.DistinctID).Time(end).
+		Options(opts...).
+		Prop(PropertyKeySessionID, s.ID).
+		Prop(PropertyKeySessionDuration, s.duration(end)).
+		Prop(PropertyKeySessionReason, reason).
+		Send()
+	if err != nil {
+		logger.Errorf("bigdata session %s of %s end failed: %s", s.ID, s.DistinctID, err.Error())
+	}
+	return err
+}
+
+// load 恢复 StateFile 中保存的会话, 恢复后删除该文件
+func (st *SessionTracker) load() error {
+	if st.conf.StateFile == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(st.conf.StateFile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	var sessions []*session
+	err = json.Unmarshal(b, &sessions)
+	if err != nil {
+		return err
+	}
+	for _, s := range sessions {
+		if s.DistinctID != "" {
+			st.sessions[s.DistinctID] = s
+		}
+	}
+	return os.Remove(st.conf.StateFile)
+}
+
+// save 将进行中的会话写入 StateFile, 先写临时文件再重命名, 避免写入中断时文件损坏
+func (st *SessionTracker) save() error {
+	st.mutex.Lock()
+	sessions := make([]*session, 0, len(st.sessions))
+	for _, s := range st.sessions {
+		sessions = append(sessions, s)
+	}
+	st.mutex.Unlock()
+
+	b, err := json.Marshal(sessions)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(st.conf.StateFile), 0o755)
+	if err != nil {
+		return err
+	}
+	tmp := st.conf.StateFile + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0o644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, st.conf.StateFile)
+}
@@ -0,0 +1,338 @@
+// Copyright (c) 2022. Homeland Interactive Technology Ltd. All rights reserved.
+
+package ruixuego
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	sinkDefaultQueueSize        = 10000
+	sinkDefaultBatchSize        = 100
+	sinkDefaultFlushInterval    = time.Second
+	sinkDefaultRetryInterval    = time.Second
+	sinkDefaultRetryMaxInterval = 30 * time.Second
+	sinkDefaultMaxRetries       = 3
+)
+
+// Sink 埋点数据的其他输出目标, 如自有的数据管道
+// 与上报瑞雪云共用同一份数据, Send 中不能修改 logs, Send 返回后 SDK 会复用这些数据, 需要异步处理时应先复制或编码
+type Sink interface {
+	// Send 发送一批数据, 返回错误时按 SinkConfig 的配置重试
+	Send(logs []*BigDataLog) error
+}
+
+// SinkFunc 函数形式的 Sink
+type SinkFunc func(logs []*BigDataLog) error
+
+func (f SinkFunc) Send(logs []*BigDataLog) error {
+	return f(logs)
+}
+
+// SinkConfig 输出目标配置
+// 每个输出目标有独立的队列与上报任务, 队列满时丢弃最早的数据, 输出目标变慢或不可用时不会影响上报瑞雪云及其他输出目标
+// 调试模式 (BigDataConfig.DryRun) 下事件不会写入输出目标
+type SinkConfig struct {
+	Name             string        `json:"name"`               // 名称, 用于日志与统计, 不能重复
+	Sink             Sink          `json:"-"`                  // 自定义输出目标, 与 Writer 二选一
+	Writer           LogWriter     `json:"-"`                  // 使用 LogWriter 作为输出目标, 如 FileWriter, 与 Sink 二选一
+	QueueSize        int           `json:"queue_size"`         // 队列容量, 默认 10000
+	BatchSize        int           `json:"batch_size"`         // 每批条数, 默认 100
+	FlushInterval    time.Duration `json:"flush_interval"`     // 队列不足一批时的发送间隔, 默认 1 秒
+	RetryInterval    time.Duration `json:"retry_interval"`     // 发送失败后首次重试间隔, 之后按指数退避, 默认 1 秒
+	RetryMaxInterval time.Duration `json:"retry_max_interval"` // 发送失败后最大重试间隔, 默认 30 秒
+	MaxRetries       int           `json:"max_retries"`        // 每批最多重试次数, 超过后丢弃该批数据, 默认 3
+	_done            bool
+}
+
+func (conf *SinkConfig) done() {
+	if conf._done {
+		return
+	}
+	if conf.QueueSize <= 0 {
+		conf.QueueSize = sinkDefaultQueueSize
+	}
+	if conf.BatchSize <= 0 {
+		conf.BatchSize = sinkDefaultBatchSize
+	}
+	if conf.FlushInterval <= 0 {
+		conf.FlushInterval = sinkDefaultFlushInterval
+	}
+	if conf.RetryInterval <= 0 {
+		conf.RetryInterval = sinkDefaultRetryInterval
+	}
+	if conf.RetryMaxInterval < conf.RetryInterval {
+		conf.RetryMaxInterval = sinkDefaultRetryMaxInterval
+		if conf.RetryMaxInterval < conf.RetryInterval {
+			conf.RetryMaxInterval = conf.RetryInterval
+		}
+	}
+	if conf.MaxRetries <= 0 {
+		conf.MaxRetries = sinkDefaultMaxRetries
+	}
+	conf._done = true
+}
+
+// checkSinks 检查输出目标配置
+func (conf *BigDataConfig) checkSinks() error {
+	names := make(map[string]struct{}, len(conf.Sinks))
+	for _, sc := range conf.Sinks {
+		if sc == nil || sc.Name == "" {
+			return fmt.Errorf("%w: sink name is empty", ErrInvalidParam)
+		}
+		if _, ok := names[sc.Name]; ok {
+			return fmt.Errorf("%w: duplicate sink %s", ErrInvalidParam, sc.Name)
+		}
+		names[sc.Name] = struct{}{}
+		if (sc.Sink == nil) == (sc.Writer == nil) {
+			return fmt.Errorf("%w: sink %s must have either Sink or Writer", ErrInvalidParam, sc.Name)
+		}
+		sc.done()
+	}
+	return nil
+}
+
+// SinkStats 输出目标的运行统计
+type SinkStats struct {
+	Name    string `json:"name"`    // 名称
+	Sent    int64  `json:"sent"`    // 发送成功的事件数
+	Failed  int64  `json:"failed"`  // 重试后仍发送失败被丢弃的事件数
+	Dropped int64  `json:"dropped"` // 队列满被丢弃的事件数
+	Queued  int    `json:"queued"`  // 队列中待发送的事件数
+}
+
+// writerSink 将 LogWriter 作为 Sink 使用
+// 内置的 LogWriter 写出后会释放数据, 每次写入前增加引用计数, 由 sinkQueue 在发送结束后释放自己持有的引用
+type writerSink struct {
+	w LogWriter
+}
+
+func (s writerSink) Send(logs []*BigDataLog) error {
+	for _, logData := range logs {
+		logData.retain()
+	}
+	return s.w.Write(logs...)
+}
+
+func newSinkQueue(conf *SinkConfig) *sinkQueue {
+	q := &sinkQueue{
+		conf:   conf,
+		sink:   conf.Sink,
+		notify: make(chan struct{}, 1),
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if conf.Writer != nil {
+		q.sink = writerSink{w: conf.Writer}
+	}
+	return q
+}
+
+// sinkQueue 输出目标的队列, 由独立的任务批量发送
+type sinkQueue struct {
+	sent    int64
+	failed  int64
+	dropped int64
+
+	conf   *SinkConfig
+	sink   Sink
+	mutex  sync.Mutex
+	queue  []*BigDataLog
+	notify chan struct{}
+	closed chan struct{}
+	done   chan struct{}
+}
+
+func (q *sinkQueue) init() error {
+	if q.conf.Writer != nil {
+		err := q.conf.Writer.Init()
+		if err != nil {
+			return err
+		}
+	}
+	go q.run()
+	return nil
+}
+
+// enqueue 数据加入队列, 不会阻塞; 队列持有每条数据的一个引用
+func (q *sinkQueue) enqueue(logs []*BigDataLog) {
+	q.mutex.Lock()
+	for _, logData := range logs {
+		logData.retain()
+	}
+	q.queue = append(q.queue, logs...)
+	if n := len(q.queue) - q.conf.QueueSize; n > 0 {
+		releaseLogs(q.queue[:n])
+		remain := copy(q.queue, q.queue[n:])
+		for i := remain; i < len(q.queue); i++ {
+			q.queue[i] = nil
+		}
+		q.queue = q.queue[:remain]
+		atomic.AddInt64(&q.dropped, int64(n))
+	}
+	full := len(q.queue) >= q.conf.BatchSize
+	q.mutex.Unlock()
+
+	if full {
+		select {
+		case q.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (q *sinkQueue) run() {
+	defer close(q.done)
+	ticker := time.NewTicker(q.conf.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.notify:
+		case <-ticker.C:
+		case <-q.closed:
+			q.sendAll()
+			return
+		}
+		q.sendAll()
+	}
+}
+
+// sendAll 按批发送队列中的所有数据
+func (q *sinkQueue) sendAll() {
+	for {
+		q.mutex.Lock()
+		n := len(q.queue)
+		if n > q.conf.BatchSize {
+			n = q.conf.BatchSize
+		}
+		batch := make([]*BigDataLog, n)
+		copy(batch, q.queue)
+		remain := copy(q.queue, q.queue[n:])
+		for i := remain; i < len(q.queue); i++ {
+			q.queue[i] = nil
+		}
+		q.queue = q.queue[:remain]
+		q.mutex.Unlock()
+
+		if n == 0 {
+			return
+		}
+		q.send(batch)
+	}
+}
+
+// send 发送一批数据, 失败时按指数退避重试, 关闭后不再等待重试
+func (q *sinkQueue) send(batch []*BigDataLog) {
+	defer releaseLogs(batch)
+	var err error
+	for i := 0; i <= q.conf.MaxRetries; i++ {
+		if i > 0 && !q.wait(i) {
+			break
+		}
+		err = q.sink.Send(batch)
+		if err == nil {
+			atomic.AddInt64(&q.sent, int64(len(batch)))
+			return
+		}
+	}
+	atomic.AddInt64(&q.failed, int64(len(batch)))
+	logger.Errorf("bigdata sink %s send %d logs failed: %s", q.conf.Name, len(batch), err.Error())
+}
+
+// wait 等待第 n 次重试, 已关闭时返回 false
+func (q *sinkQueue) wait(n int) bool {
+	d := q.conf.RetryMaxInterval
+	if n < 32 {
+		if e := q.conf.RetryInterval << uint(n-1); e > 0 && e < d {
+			d = e
+		}
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-q.closed:
+		return false
+	}
+}
+
+// close 发送队列中剩余的数据并关闭 LogWriter
+func (q *sinkQueue) close() error {
+	close(q.closed)
+	<-q.done
+	if q.conf.Writer != nil {
+		return q.conf.Writer.Close()
+	}
+	return nil
+}
+
+func (q *sinkQueue) stats() *SinkStats {
+	q.mutex.Lock()
+	queued := len(q.queue)
+	q.mutex.Unlock()
+	return &SinkStats{
+		Name:    q.conf.Name,
+		Sent:    atomic.LoadInt64(&q.sent),
+		Failed:  atomic.LoadInt64(&q.failed),
+		Dropped: atomic.LoadInt64(&q.dropped),
+		Queued:  queued,
+	}
+}
+
+// write 将事件写入各个输出目标的队列, DurableWriter 及 LogWriter
+// 先写入其他目标再写入 LogWriter, 内置的 LogWriter 写出后会释放数据
+func (p *Producer) write(logs ...*BigDataLog) error {
+	p.fanOut(logs)
+	return p.writer.Write(logs...)
+}
+
+// fanOut 将事件写入各个输出目标的队列及 DurableWriter, 不写入 LogWriter, 调用方仍持有 logs 的引用
+// 调试模式下不写入, 事件只交给 DryRunHandler
+func (p *Producer) fanOut(logs []*BigDataLog) {
+	if p.conf.DryRun {
+		return
+	}
+	for _, q := range p.sinks {
+		q.enqueue(logs)
+	}
+	if p.conf.DurableWriter != nil {
+		p.writeDurable(logs)
+	}
+}
+
+// writeDurable 将高优先级事件写入 DurableWriter, 写入失败只记录日志, 不影响上报
+func (p *Producer) writeDurable(logs []*BigDataLog) {
+	var high []*BigDataLog
+	for _, logData := range logs {
+		if logData.priority == PriorityHigh {
+			logData.retain()
+			high = append(high, logData)
+		}
+	}
+	if len(high) == 0 {
+		return
+	}
+	err := p.conf.DurableWriter.Write(high...)
+	if err != nil {
+		logger.Errorf("bigdata durable writer write %d logs failed: %s", len(high), err.Error())
+	}
+}
+
+// closeSinks 关闭所有输出目标, 返回第一个错误
+func (p *Producer) closeSinks() error {
+	var ret error
+	for _, q := range p.sinks {
+		err := q.close()
+		if err != nil {
+			logger.Errorf("bigdata sink %s close failed: %s", q.conf.Name, err.Error())
+			if ret == nil {
+				ret = err
+			}
+		}
+	}
+	return ret
+}
@@ -0,0 +1,41 @@
+// Copyright (c) 2022. Homeland Interactive Technology Ltd. All rights reserved.
+
+package ruixuego
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestDryRunSkipsSinks(t *testing.T) {
+	var handled, sunk int64
+	durable := &captureWriter{}
+	p, _ := newTestProducer(t, &BigDataConfig{
+		DryRun: true,
+		DryRunHandler: func(logs []*BigDataLog) {
+			atomic.AddInt64(&handled, int64(len(logs)))
+		},
+		DurableWriter: durable,
+		Sinks: []*SinkConfig{{Name: "s", Sink: SinkFunc(func(logs []*BigDataLog) error {
+			atomic.AddInt64(&sunk, int64(len(logs)))
+			return nil
+		})}},
+	})
+
+	if err := p.Event("normal").Device("d").Send(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Event("high").Device("d").Priority(PriorityHigh).Send(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if handled != 2 {
+		t.Errorf("got %d dry run events, want 2", handled)
+	}
+	if sunk != 0 || len(durable.written()) != 0 {
+		t.Errorf("got %d sink events and %d durable events in dry run, want 0", sunk, len(durable.written()))
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2022. Homeland Interactive Technology Ltd. All rights reserved.
+
+package ruixuego
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ProducerStats Producer 运行统计, 可用于健康检查接口
+type ProducerStats struct {
+	Accepted            int64        `json:"accepted"`              // 写入缓冲的事件数
+	Rejected            int64        `json:"rejected"`              // 被拒绝的事件总数
+	RejectedDevicecode  int64        `json:"rejected_devicecode"`   // devicecode 与 distinctID 均为空被拒绝的事件数
+	RejectedType        int64        `json:"rejected_type"`         // 类型无效被拒绝的事件数
+	RejectedCPID        int64        `json:"rejected_cpid"`         // CPID 无效被拒绝的事件数
+	RejectedOther       int64        `json:"rejected_other"`        // 其他原因 (事件名, 属性校验等) 被拒绝的事件数
+	Filtered            int64        `json:"filtered"`              // 被黑白名单, 采样或钩子丢弃的事件数
+	Deduplicated        int64        `json:"deduplicated"`          // 去重窗口内 UUID 重复被丢弃的事件数
+	Uploaded            int64        `json:"uploaded"`              // 上报成功的事件数
+	Retried             int64        `json:"retried"`               // 上报失败后放回缓存等待重试的事件数
+	Evicted             int64        `json:"evicted"`               // 超出缓存容量被丢弃的事件数
+	EvictedHighPriority int64        `json:"evicted_high_priority"` // 超出高优先级缓存容量被丢弃的高优先级事件数, 已计入 Evicted
+	InBuffer            int          `json:"in_buffer"`             // 缓冲中未满一批的事件数
+	InCache             int          `json:"in_cache"`              // 缓存中待上报或正在上报的事件数
+	BytesSent           int64        `json:"bytes_sent"`            // 上报数据压缩前的字节数
+	BytesSentCompressed int64        `json:"bytes_sent_compressed"` // 上报数据压缩后的字节数
+	LastUploadTime      time.Time    `json:"last_upload_time"`      // 最近一次上报成功的时间
+	LastError           string       `json:"last_error"`            // 最近一次上报失败的错误
+	LastErrorTime       time.Time    `json:"last_error_time"`       // 最近一次上报失败的时间
+	Sinks               []*SinkStats `json:"sinks,omitempty"`       // 其他输出目标的统计
+}
+
+// producerStats Producer 运行统计计数器
+// int64 字段放在最前面, 保证在 32 位平台上的原子操作按 64 位对齐
+type producerStats struct {
+	accepted            int64
+	rejectedDevicecode  int64
+	rejectedType        int64
+	rejectedCPID        int64
+	rejectedOther       int64
+	filtered            int64
+	deduplicated        int64
+	uploaded            int64
+	retried             int64
+	evicted             int64
+	evictedHigh         int64
+	bytesSent           int64
+	bytesSentCompressed int64
+
+	mutex          sync.RWMutex
+	lastUploadTime time.Time
+	lastError      string
+	lastErrorTime  time.Time
+}
+
+// statsWriter 可以提供缓冲统计的 LogWriter
+type statsWriter interface {
+	bufferStats() (inBuffer, inCache int)
+}
+
+func (s *producerStats) addRejected(err error) {
+	switch {
+	case errors.Is(err, ErrInvalidDevicecode):
+		atomic.AddInt64(&s.rejectedDevicecode, 1)
+	case errors.Is(err, ErrInvalidType):
+		atomic.AddInt64(&s.rejectedType, 1)
+	case errors.Is(err, ErrInvalidCPID):
+		atomic.AddInt64(&s.rejectedCPID, 1)
+	default:
+		atomic.AddInt64(&s.rejectedOther, 1)
+	}
+}
+
+func (s *producerStats) uploadSucceeded(count, bytes, compressed int) {
+	atomic.AddInt64(&s.uploaded, int64(count))
+	atomic.AddInt64(&s.bytesSent, int64(bytes))
+	atomic.AddInt64(&s.bytesSentCompressed, int64(compressed))
+	s.mutex.Lock()
+	s.lastUploadTime = time.Now()
+	s.mutex.Unlock()
+}
+
+func (s *producerStats) uploadFailed(count, bytes, compressed int, err error) {
+	atomic.AddInt64(&s.retried, int64(count))
+	s.trackFailed(bytes, compressed, err)
+}
+
+// trackFailed 记录上报失败的字节数与错误, 不计入重试数, 用于由调用方重试的同步上报
+func (s *producerStats) trackFailed(bytes, compressed int, err error) {
+	atomic.AddInt64(&s.bytesSent, int64(bytes))
+	atomic.AddInt64(&s.bytesSentCompressed, int64(compressed))
+	s.mutex.Lock()
+	s.lastError = err.Error()
+	s.lastErrorTime = time.Now()
+	s.mutex.Unlock()
+}
+
+// Stats 返回 Producer 当前的运行统计
+func (p *Producer) Stats() *ProducerStats {
+	s := p.stats
+	ret := &ProducerStats{
+		Accepted:            atomic.LoadInt64(&s.accepted),
+		RejectedDevicecode:  atomic.LoadInt64(&s.rejectedDevicecode),
+		RejectedType:        atomic.LoadInt64(&s.rejectedType),
+		RejectedCPID:        atomic.LoadInt64(&s.rejectedCPID),
+		RejectedOther:       atomic.LoadInt64(&s.rejectedOther),
+		Filtered:            atomic.LoadInt64(&s.filtered),
+		Deduplicated:        atomic.LoadInt64(&s.deduplicated),
+		Uploaded:            atomic.LoadInt64(&s.uploaded),
+		Retried:             atomic.LoadInt64(&s.retried),
+		Evicted:             atomic.LoadInt64(&s.evicted),
+		EvictedHighPriority: atomic.LoadInt64(&s.evictedHigh),
+		BytesSent:           atomic.LoadInt64(&s.bytesSent),
+		BytesSentCompressed: atomic.LoadInt64(&s.bytesSentCompressed),
+	}
+	ret.Rejected = ret.RejectedDevicecode + ret.RejectedType + ret.RejectedCPID + ret.RejectedOther
+
+	s.mutex.RLock()
+	ret.LastUploadTime = s.lastUploadTime
+	ret.LastError = s.lastError
+	ret.LastErrorTime = s.lastErrorTime
+	s.mutex.RUnlock()
+
+	if w, ok := p.writer.(statsWriter); ok {
+		ret.InBuffer, ret.InCache = w.bufferStats()
+	}
+	for _, q := range p.sinks {
+		ret.Sinks = append(ret.Sinks, q.stats())
+	}
+	return ret
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2022. Homeland Interactive Technology Ltd. All rights reserved.
+
+package ruixuego
+
+// SuperPropertiesProvider 动态公共属性, 每条事件上报时调用一次
+// 返回值中可以包含预置 Key, 如 PresetKeyProductID
+type SuperPropertiesProvider func() map[string]interface{}
+
+// SetSuperProperties 设置公共属性, 与已有的公共属性合并
+// 公共属性会合并到每条 track 类事件的 Properties 中, 预置 Key 会填充到对应的预置字段.
+// 优先级: SetProperties/SetPreset > 动态公共属性 > 静态公共属性
+// 注: 公共属性不会合并到用户属性 (SetUserUpdateType) 事件中, 但预置 Key 对所有事件生效;
+// PresetKeyCPID 只在未调用 SetPreset 时生效, 因为 SetPreset 总会设置 CPID
+func (p *Producer) SetSuperProperties(properties map[string]interface{}) {
+	p.superMutex.Lock()
+	defer p.superMutex.Unlock()
+
+	merged := make(map[string]interface{}, len(p.superProperties)+len(properties))
+	for k, v := range p.superProperties {
+		merged[k] = v
+	}
+	for k, v := range properties {
+		merged[k] = v
+	}
+	p.superProperties = merged
+}
+
+// UnsetSuperProperty 删除一个公共属性
+func (p *Producer) UnsetSuperProperty(key string) {
+	p.superMutex.Lock()
+	defer p.superMutex.Unlock()
+
+	if _, ok := p.superProperties[key]; !ok {
+		return
+	}
+	merged := make(map[string]interface{}, len(p.superProperties))
+	for k, v := range p.superProperties {
+		if k != key {
+			merged[k] = v
+		}
+	}
+	p.superProperties = merged
+}
+
+// ClearSuperProperties 清空静态公共属性
+func (p *Producer) ClearSuperProperties() {
+	p.superMutex.Lock()
+	p.superProperties = nil
+	p.superMutex.Unlock()
+}
+
+// SuperProperties 返回当前静态公共属性的副本
+func (p *Producer) SuperProperties() map[string]interface{} {
+	p.superMutex.RLock()
+	defer p.superMutex.RUnlock()
+
+	ret := make(map[string]interface{}, len(p.superProperties))
+	for k, v := range p.superProperties {
+		ret[k] = v
+	}
+	return ret
+}
+
+// SetSuperPropertiesProvider 设置动态公共属性, 传 nil 取消
+func (p *Producer) SetSuperPropertiesProvider(provider SuperPropertiesProvider) {
+	p.superMutex.Lock()
+	p.superProvider = provider
+	p.superMutex.Unlock()
+}
+
+// applySuperProperties 将公共属性合并到事件中
+func (p *Producer) applySuperProperties(logData *BigDataLog) {
+	p.superMutex.RLock()
+	static, provider := p.superProperties, p.superProvider
+	p.superMutex.RUnlock()
+
+	var dynamic map[string]interface{}
+	if provider != nil {
+		dynamic = provider()
+	}
+	if len(static) == 0 && len(dynamic) == 0 {
+		return
+	}
+
+	// 预置字段只在为空时填充, 所以先填充优先级高的动态公共属性
+	fillSuperPreset(logData, dynamic)
+	fillSuperPreset(logData, static)
+
+	if logData.Type == typeUser {
+		return
+	}
+
+	merged := newProperties()
+	copySuperProperties(merged, static)
+	copySuperProperties(merged, dynamic)
+	for k, v := range logData.Properties {
+		merged[k] = v
+	}
+	logData.setProperties(merged, true)
+}
+
+// copySuperProperties 复制公共属性, 预置 Key 已填充到预置字段, 不再复制
+func copySuperProperties(dst, src map[string]interface{}) {
+	for k, v := range src {
+		if _, ok := presetKeys[k]; ok {
+			continue
+		}
+		dst[k] = v
+	}
+}
+
+func fillSuperPreset(logData *BigDataLog, m map[string]interface{}) {
+	if len(m) == 0 {
+		return
+	}
+	if logData.CPID == 0 {
+		if v, ok := m[PresetKeyCPID].(uint32); ok {
+			logData.CPID = v
+		}
+	}
+	if logData.PlatformID <= 0 {
+		logData.PlatformID = extractInt32(m, PresetKeyPlatformID)
+	}
+	if logData.ProductID == "" {
+		logData.ProductID = extractStringProperty(m, PresetKeyProductID)
+	}
+	if logData.ChannelID == "" {
+		logData.ChannelID = extractStringProperty(m, PresetKeyChannelID)
+	}
+	if logData.SubChannelID == "" {
+		logData.SubChannelID = extractStringProperty(m, PresetKeySubChannelID)
+	}
+	if logData.IP == "" {
+		logData.IP = extractStringProperty(m, PresetKeyIP)
+	}
+	if logData.region == "" {
+		logData.region = extractStringProperty(m, PresetKeyRegion)
+	}
+	if logData.serviceMark == "" {
+		logData.serviceMark = extractStringProperty(m, PresetKeyServiceMark)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2022. Homeland Interactive Technology Ltd. All rights reserved.
+
+package ruixuego
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+// setTestConfig 设置测试使用的全局配置, 测试结束后恢复
+func setTestConfig(t *testing.T, conf *Config) {
+	t.Helper()
+	old := config
+	config = conf
+	t.Cleanup(func() { config = old })
+}
+
+// captureWriter 记录写入数据的 LogWriter
+type captureWriter struct {
+	mutex sync.Mutex
+	logs  []*BigDataLog
+}
+
+func (w *captureWriter) Init() error { return nil }
+
+func (w *captureWriter) Write(logs ...*BigDataLog) error {
+	w.mutex.Lock()
+	w.logs = append(w.logs, logs...)
+	w.mutex.Unlock()
+	return nil
+}
+
+func (w *captureWriter) Flush() error { return nil }
+
+func (w *captureWriter) Close() error { return nil }
+
+func (w *captureWriter) written() []*BigDataLog {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return append([]*BigDataLog(nil), w.logs...)
+}
+
+// newTestProducer 使用 captureWriter 创建 Producer
+func newTestProducer(t *testing.T, conf *BigDataConfig) (*Producer, *captureWriter) {
+	t.Helper()
+	setTestConfig(t, &Config{CPID: 1})
+	w := &captureWriter{}
+	if conf.Writer == nil && !conf.DryRun {
+		conf.Writer = w
+	}
+	p, err := NewProducer(nil, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, w
+}
+
+// TestProducerWithoutConfig 未调用 Init 时, 未设置 CPID 的事件返回 ErrInvalidCPID
+func TestProducerWithoutConfig(t *testing.T) {
+	w := &captureWriter{}
+	p, err := NewProducer(nil, &BigDataConfig{Writer: w})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	setTestConfig(t, nil)
+
+	if err = p.Tracks("d", "u", SetEvent("e")); !errors.Is(err, ErrInvalidCPID) {
+		t.Errorf("Tracks: got %v, want ErrInvalidCPID", err)
+	}
+	if err = p.Tracks("d", "u", SetEvent("e"), SetPreset(map[string]interface{}{})); !errors.Is(err, ErrInvalidCPID) {
+		t.Errorf("SetPreset: got %v, want ErrInvalidCPID", err)
+	}
+	if err = p.Event("e").Device("d").Send(); !errors.Is(err, ErrInvalidCPID) {
+		t.Errorf("Send: got %v, want ErrInvalidCPID", err)
+	}
+	if err = p.Event("e").Device("d").CPID(1).Send(); err != nil {
+		t.Errorf("Send with CPID: %v", err)
+	}
+	if n := len(w.written()); n != 1 {
+		t.Errorf("got %d logs, want 1", n)
+	}
+}
@@ -278,11 +278,15 @@ type ReqLBSRadius struct {
 	Count    []int
 }
 
+// ReqTrack 埋点上报请求
+// Producer 批量上报时传给自定义 TrackInterface 的 Data 为独立的副本, Track 返回后可以继续持有
 type ReqTrack struct {
 	ReqHeader
 	Data     []byte
 	LogCount int
 	Compress bool
+	Encoding string // Data 已使用的压缩编码, 如 gzip. 不为空时 Track 不再压缩, 忽略 Compress
+	TraceID  string // 请求唯一标识, 为空时自动生成
 }
 
 type ReqSyncTrack struct {
@@ -292,6 +296,12 @@ type ReqSyncTrack struct {
 	Opts       []BigdataOptions
 }
 
+type ReqSyncTrackBatch struct {
+	ReqHeader
+	Tracks      []*ReqSyncTrack
+	Concurrency int // 并发上报的批次数, 默认 1
+}
+
 type ReqCreateRank struct {
 	ReqHeader
 	RankID      string